@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Actions of the notify responses which the agent honors, see ZETTO_NOTIFY_ACTIONS
+var notifyActions = map[string]bool{"pause": true, "drain": true}
+
+// Instruction optionally carried by a notify response, such as {"action":"pause","seconds":300} or {"action":"drain"}
+type notifyAction struct {
+	Action  string `json:"action"`
+	Seconds int    `json:"seconds"`
+}
+
+// Unix time in nanoseconds until which claiming is paused by the server
+var pausedUntil int64
+
+func parseNotifyActions(spec string) map[string]bool {
+	actions := map[string]bool{}
+	for _, action := range strings.Split(spec, ",") {
+		if action = strings.TrimSpace(action); action != "" {
+			actions[action] = true
+		}
+	}
+	return actions
+}
+
+// Act on the instruction of a successful notify response. Empty bodies, and bodies without an action, are ignored
+func handleNotifyResponse(body []byte) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return
+	}
+
+	var action notifyAction
+	if err := json.Unmarshal(body, &action); err != nil || action.Action == "" {
+		return
+	}
+
+	if !notifyActions[action.Action] {
+		agentLog.Warnf("Ignoring notify action %q\n", action.Action)
+		return
+	}
+
+	switch action.Action {
+	case "pause":
+		if action.Seconds <= 0 {
+			agentLog.Warnf("Ignoring pause action of %d seconds\n", action.Seconds)
+			return
+		}
+		pause := time.Duration(action.Seconds) * time.Second
+		log.Printf("Pausing claims for %s, as requested by the server\n", pause)
+		atomic.StoreInt64(&pausedUntil, time.Now().Add(pause).UnixNano())
+
+	case "drain":
+		log.Println("Draining, as requested by the server : exiting once the running jobs are done")
+		requestShutdown()
+
+	default:
+		agentLog.Warnf("Ignoring unknown notify action %q\n", action.Action)
+	}
+}
+
+// Remaining time of the pause requested by the server, 0 when claiming is not paused
+func claimsPausedFor() time.Duration {
+	remaining := time.Until(time.Unix(0, atomic.LoadInt64(&pausedUntil)))
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CPUs the jobs are pinned to, nil to let them run on any
+var jobCPUSet []int
+
+// CPUs the jobs of some commands are pinned to, overriding jobCPUSet
+var commandCPUSets = map[string][]int{}
+
+// Parse a CPU list in the Linux cpuset format, such as "0-3,8"
+func parseCPUSet(spec string) ([]int, error) {
+	cpus := []int{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("Invalid CPU %q", part)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, fmt.Errorf("Invalid CPU range %q", part)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+
+	return cpus, nil
+}
+
+// Parse CPU sets per command, separated by semicolons as CPU lists hold commas, such as "build:0-3,8;deploy:4"
+func parseCommandCPUSets(spec string) (map[string][]int, error) {
+	sets := map[string][]int{}
+	if strings.TrimSpace(spec) == "" {
+		return sets, nil
+	}
+
+	for _, entry := range strings.Split(spec, ";") {
+		parts := strings.SplitN(entry, ":", 2)
+		command := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || command == "" {
+			return nil, fmt.Errorf("Invalid entry %q", entry)
+		}
+		cpus, err := parseCPUSet(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		sets[command] = cpus
+	}
+
+	return sets, nil
+}
+
+// CPUs a job is pinned to, nil when it is not
+func jobCPUs(job jobConfig) []int {
+	if cpus, ok := commandCPUSets[job.Command]; ok {
+		return cpus
+	}
+	return jobCPUSet
+}
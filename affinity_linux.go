@@ -0,0 +1,30 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// CPU affinity is supported on this platform
+const affinitySupported = true
+
+// Pin a process to a set of CPUs with sched_setaffinity. The processes it spawns afterwards inherit it
+func setCPUAffinity(pid int, cpus []int) error {
+	max := 0
+	for _, cpu := range cpus {
+		if cpu > max {
+			max = cpu
+		}
+	}
+
+	mask := make([]uint64, max/64+1)
+	for _, cpu := range cpus {
+		mask[cpu/64] |= 1 << uint(cpu%64)
+	}
+
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(pid), uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+// CPU affinity is only set on Linux
+const affinitySupported = false
+
+func setCPUAffinity(pid int, cpus []int) error {
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Connection of the agent to the API : where it is, how the agent authenticates, and the clients used for the calls
+type Agent struct {
+	BaseURL    string
+	APIKey     string
+	RunnerName string
+	UserAgent  string
+	Client     *http.Client
+
+	// Client of the polls, which long polls hold open
+	PollClient *http.Client
+
+	// Client of the result notifies, whose payloads may take longer to upload
+	NotifyClient *http.Client
+
+	// Base URLs the results are delivered to, see deliverResult. Only BaseURL by default
+	NotifyEndpoints []string
+}
+
+// API key of the agent, from ZETTO_API_KEY_FILE or ZETTO_API_KEY, loaded by loadConfig
+var apiKey string
+
+// Read an API key file, such as a mounted secret. Its content is trimmed, and must not be empty
+func readAPIKeyFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	key := strings.TrimSpace(string(content))
+	if key == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return key, nil
+}
+
+// Build the agent from ZETTO_HOST and the API key of the configuration, named after the host it runs on
+func NewAgentFromEnv() (*Agent, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	agent := &Agent{
+		BaseURL:    os.Getenv("ZETTO_HOST"),
+		APIKey:     apiKey,
+		RunnerName: hostname,
+		UserAgent:  userAgent(hostname),
+		Client:     newHTTPClient(httpTimeout),
+
+		PollClient:      newHTTPClient(pollTimeout()),
+		NotifyClient:    newHTTPClient(notifyTimeout),
+		NotifyEndpoints: notifyEndpoints(os.Getenv("ZETTO_NOTIFY_ENDPOINTS")),
+	}
+	if len(agent.NotifyEndpoints) == 0 {
+		agent.NotifyEndpoints = []string{agent.BaseURL}
+	}
+
+	return agent, nil
+}
+
+// Parse a comma-separated list of base URLs
+func notifyEndpoints(spec string) []string {
+	endpoints := []string{}
+	for _, endpoint := range strings.Split(spec, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// Build an authenticated request to an endpoint of the API
+func (a *Agent) newRequest(method string, endpoint string, body io.Reader) (*http.Request, error) {
+	return a.newRequestTo(a.BaseURL, method, endpoint, body)
+}
+
+// Build an authenticated request to an endpoint of the API at baseURL
+func (a *Agent) newRequestTo(baseURL string, method string, endpoint string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/%s", baseURL, endpoint), body)
+	if err != nil {
+		return nil, err
+	}
+	a.setHeaders(req)
+
+	return req, nil
+}
+
+// Set the headers of every call to the API : credentials, runner name, User-Agent, and the type of the payload if any
+func (a *Agent) setHeaders(req *http.Request) {
+	if a.APIKey != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("ApiKey %s", a.APIKey))
+	}
+	req.Header.Add("X-Runner-Name", a.RunnerName)
+	req.Header.Add("User-Agent", a.UserAgent)
+	if req.Body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+}
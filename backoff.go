@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"time"
+)
+
+// Window over which agents spread their first poll after an outage, so a recovering fleet does not reconnect all at once
+var recoverySpread = 30 * time.Second
+
+// Fraction of the polling interval randomly added to the sleep after an empty poll, so agents started together drift
+// apart instead of polling in lockstep. 0 disables it
+var pollJitter float64
+
+// Source of the poll jitter, seeded per process so each agent of a fleet draws its own delays. Only used by the poll loop
+var pollRand = rand.New(rand.NewSource(time.Now().UnixNano() ^ int64(os.Getpid())))
+
+// Sleep after an empty poll, between the polling interval and (1 + ZETTO_POLL_JITTER) times it
+func idlePollInterval() time.Duration {
+	if pollJitter <= 0 {
+		return pollingInterval
+	}
+
+	return pollingInterval + time.Duration(pollRand.Float64()*pollJitter*float64(pollingInterval))
+}
+
+// Upper bound of the delay between polls while the API is failing
+var maxPollBackoff = 5 * time.Minute
+
+// Consecutive poll failures after which the agent shuts down, 0 to keep retrying
+var maxPollFailures int
+
+// Delay growing on consecutive failures, from a base delay up to a max
+type backoff struct {
+	base     time.Duration
+	max      time.Duration
+	failures int
+	current  time.Duration
+}
+
+func newBackoff(base time.Duration, max time.Duration) *backoff {
+	return &backoff{
+		base: base,
+		max:  max,
+	}
+}
+
+// Count a failure, and return the delay to wait before trying again
+func (b *backoff) failed() time.Duration {
+	b.failures++
+	if b.current == 0 {
+		b.current = b.base
+	} else {
+		b.current *= 2
+	}
+	if b.current > b.max {
+		b.current = b.max
+	}
+
+	return b.current
+}
+
+// Random delay added to a retry, so the first one reaching a recovered API is spread over the fleet. It is weighted by
+// how far the backoff went : the longer the outage, the more agents are likely to be in sync
+func (b *backoff) spread() time.Duration {
+	window := recoverySpread
+	if b.current < window {
+		window = b.current
+	}
+
+	if window <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(window)))
+}
+
+// Reset after a success
+func (b *backoff) succeeded() {
+	b.failures = 0
+	b.current = 0
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Whether the agent tells the API when it stops claiming jobs for lack of capacity, and when it resumes
+var busySignal bool
+
+// Why the agent is not claiming jobs, empty while it has capacity. Only used by the poll loop
+var busyReason string
+
+type runnerBusy struct {
+	Busy   bool   `json:"busy"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Report that claiming stopped for the given reason, or resumed when it is empty. Only changes are sent, and as servers
+// may not support the signal its failures are only logged in debug
+func (a *Agent) setBusy(reason string) {
+	if !busySignal || reason == busyReason {
+		return
+	}
+	busyReason = reason
+
+	if err := a.sendBusy(runnerBusy{Busy: reason != "", Reason: reason}); err != nil {
+		agentLog.Debugf("Error sending the busy signal : %v\n", err)
+	}
+}
+
+func (a *Agent) sendBusy(busy runnerBusy) error {
+	payload, err := json.Marshal(busy)
+	if err != nil {
+		return err
+	}
+
+	req, err := a.newRequest("POST", "busy", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+
+	res, err := a.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Busy error %d", res.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// Whether polls describe the agent's full capabilities rather than just its commands
+var richCapabilities bool
+
+// What the agent can run and within which limits, for the API to schedule jobs on it
+type capabilities struct {
+	Commands      json.RawMessage `json:"commands"`
+	InputModes    []string        `json:"input_modes"`
+	Concurrency   int             `json:"concurrency"`
+	MaxTimeoutS   int64           `json:"max_timeout_s"`
+	Isolated      bool            `json:"isolated"`
+	Features      []string        `json:"features,omitempty"`
+	JSONCommands  []string        `json:"json_output_commands,omitempty"`
+	CommandLimits map[string]int  `json:"command_limits,omitempty"`
+}
+
+var (
+	capabilitiesMu sync.Mutex
+
+	// Capabilities payload, built along with the command list
+	capabilitiesJSON string
+)
+
+// Build the capabilities payload for a freshly listed set of commands
+func refreshCapabilities(commands string) {
+	if !richCapabilities {
+		return
+	}
+
+	caps := capabilities{
+		Commands:    json.RawMessage(commands),
+		InputModes:  []string{inputMode},
+		Concurrency: hardConcurrency,
+		MaxTimeoutS: int64(maxTimeout.Seconds()),
+		Isolated:    isolateJobs,
+	}
+	if len(commandSlots) > 0 {
+		caps.CommandLimits = commandLimits()
+	}
+	for feature := range features {
+		caps.Features = append(caps.Features, feature)
+	}
+	sort.Strings(caps.Features)
+	for command := range jsonOutputCommands {
+		caps.JSONCommands = append(caps.JSONCommands, command)
+	}
+	sort.Strings(caps.JSONCommands)
+
+	payload, err := json.Marshal(caps)
+	capabilitiesMu.Lock()
+	defer capabilitiesMu.Unlock()
+	if err != nil {
+		agentLog.Errorf("Error building the capabilities : %v\n", err)
+		capabilitiesJSON = ""
+		return
+	}
+	capabilitiesJSON = string(payload)
+}
+
+// Capabilities payload to send with the command list, empty when not enabled
+func currentCapabilities() string {
+	capabilitiesMu.Lock()
+	defer capabilitiesMu.Unlock()
+
+	return capabilitiesJSON
+}
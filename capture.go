@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// Most bytes of each output stream (STDOUT, STDERR) kept from a run, 0 for no limit
+var maxOutputBytes = 10 * 1024 * 1024
+
+// Limits of STDOUT and STDERR on their own, maxOutputBytes unless set
+var (
+	maxStdoutBytes int
+	maxStderrBytes int
+)
+
+// Closed the first time a stream of a run reaches its limit
+type captureLimit struct {
+	reached chan struct{}
+	once    sync.Once
+}
+
+func newCaptureLimit() *captureLimit {
+	return &captureLimit{
+		reached: make(chan struct{}),
+	}
+}
+
+func (l *captureLimit) hit() {
+	l.once.Do(func() {
+		close(l.reached)
+	})
+}
+
+// Writer keeping at most limit bytes, so a runaway command can not exhaust the agent's memory.
+// What is over the limit is discarded, rather than failing the write, so the command never blocks on a full pipe
+type cappedWriter struct {
+	mu        sync.Mutex
+	out       io.Writer
+	limit     int
+	written   int
+	truncated bool
+	reached   *captureLimit
+}
+
+func newCappedWriter(out io.Writer, limit int, reached *captureLimit) *cappedWriter {
+	return &cappedWriter{
+		out:     out,
+		limit:   limit,
+		reached: reached,
+	}
+}
+
+func (w *cappedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.limit <= 0 {
+		return w.out.Write(p)
+	}
+	size := len(p)
+	if w.truncated {
+		return size, nil
+	}
+
+	if room := w.limit - w.written; size > room {
+		w.truncated = true
+		w.reached.hit()
+		p = p[:room]
+	}
+	w.written += len(p)
+	if _, err := w.out.Write(p); err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// Whether some of the stream was discarded
+func (w *cappedWriter) wasTruncated() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.truncated
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Cgroup v2 directory under which each job gets its own cgroup, empty when disabled
+var cgroupParent string
+
+// Enable per-job cgroups under a parent cgroup, if it is usable
+func initCgroups(parent string) {
+	if parent == "" {
+		return
+	}
+
+	if _, err := os.Stat(filepath.Join(parent, "cgroup.procs")); err != nil {
+		agentLog.Warnf("Cgroup %s is not usable (%v), jobs will run in the agent's cgroup\n", parent, err)
+		return
+	}
+
+	cgroupParent = parent
+}
+
+// Move a started job process into its own cgroup, and return a function removing it once the job is over
+func joinJobCgroup(job jobConfig, pid int) func() {
+	if cgroupParent == "" {
+		return func() {}
+	}
+
+	// Run IDs come from the API, only keep characters which are safe in a directory name
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, job.ID)
+	dir := filepath.Join(cgroupParent, "zetto-"+name)
+
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		runLog(job).Warnf("Could not create job cgroup : %v\n", err)
+		return func() {}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		runLog(job).Warnf("Could not move job into its cgroup : %v\n", err)
+		os.Remove(dir)
+		return func() {}
+	}
+
+	return func() {
+		// Fails while processes spawned by the job are still alive in the cgroup
+		if err := os.Remove(dir); err != nil {
+			runLog(job).Warnf("Could not remove job cgroup : %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import "log"
+
+// Cgroups only exist on Linux
+func initCgroups(parent string) {
+	if parent != "" {
+		log.Println("Cgroups are not supported on this platform, ignoring ZETTO_CGROUP_PARENT")
+	}
+}
+
+func joinJobCgroup(job jobConfig, pid int) func() {
+	return func() {}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Failure rate over the window opening the circuit of a command, 0 disables circuit breaking
+var circuitFailureRate float64
+
+// Failure rates overriding circuitFailureRate for some commands
+var circuitFailureRates = map[string]float64{}
+
+// Number of latest runs of a command the failure rate is computed on, and how many are needed to judge it
+var (
+	circuitWindow  = 20
+	circuitMinRuns = 5
+)
+
+// Time a circuit stays open before a probe run is let through
+var circuitCooldown = time.Minute
+
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+type circuit struct {
+	// Latest outcomes, true for a failure
+	outcomes []bool
+	state    int
+	since    time.Time
+}
+
+// Per-command circuits : a command failing too often is declined for a while, without affecting the others
+type circuitBreakers struct {
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+var circuits = &circuitBreakers{
+	circuits: map[string]*circuit{},
+}
+
+func circuitThreshold(command string) float64 {
+	if rate, ok := circuitFailureRates[command]; ok {
+		return rate
+	}
+	return circuitFailureRate
+}
+
+// Whether a job of this command may run. Once the cool-down elapsed, a single probe run is let through
+func (b *circuitBreakers) allow(command string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[command]
+	if !ok || c.state == circuitClosed {
+		return true
+	}
+
+	// A probe may be lost, such as when cancelled, another one is let through after a cool-down
+	if now.Sub(c.since) < circuitCooldown {
+		return false
+	}
+	log.Printf("Probing the circuit of command %s\n", command)
+	c.state = circuitHalfOpen
+	c.since = now
+	return true
+}
+
+// Account for the outcome of a run, opening or closing the circuit of its command
+func (b *circuitBreakers) record(command string, failed bool, now time.Time) {
+	threshold := circuitThreshold(command)
+	if threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[command]
+	if !ok {
+		c = &circuit{}
+		b.circuits[command] = c
+	}
+
+	if c.state == circuitHalfOpen {
+		if failed {
+			log.Printf("Probe of command %s failed, circuit open again\n", command)
+			c.state = circuitOpen
+		} else {
+			log.Printf("Probe of command %s succeeded, circuit closed\n", command)
+			c.state = circuitClosed
+			c.outcomes = nil
+		}
+		c.since = now
+		return
+	}
+	if c.state == circuitOpen {
+		return
+	}
+
+	c.outcomes = append(c.outcomes, failed)
+	if len(c.outcomes) > circuitWindow {
+		c.outcomes = c.outcomes[len(c.outcomes)-circuitWindow:]
+	}
+	if len(c.outcomes) < circuitMinRuns {
+		return
+	}
+
+	failures := 0
+	for _, outcome := range c.outcomes {
+		if outcome {
+			failures++
+		}
+	}
+	if rate := float64(failures) / float64(len(c.outcomes)); rate >= threshold {
+		agentLog.Warnf("Command %s failed %d of its last %d runs, circuit open for %s\n", command, failures, len(c.outcomes), circuitCooldown)
+		c.state = circuitOpen
+		c.since = now
+	}
+}
+
+// Write the state of each circuit in the Prometheus text format
+func (b *circuitBreakers) write(w io.Writer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP zetto_circuit_state State of the circuit of each command : 0 closed, 1 open, 2 half-open\n# TYPE zetto_circuit_state gauge\n")
+	commands := make([]string, 0, len(b.circuits))
+	for command := range b.circuits {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	for _, command := range commands {
+		fmt.Fprintf(w, "zetto_circuit_state%s %d\n", renderLabels([]string{"command"}, []string{command}), b.circuits[command].state)
+	}
+}
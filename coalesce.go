@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+)
+
+// Commands whose identical jobs running at the same time are run once, each job being notified of the same result
+var coalescedCommands = map[string]bool{}
+
+// Run shared by identical jobs, led by the first of them
+type coalescedRun struct {
+	leader string
+	done   chan struct{}
+	result runResult
+}
+
+var (
+	coalesceMu    sync.Mutex
+	coalescedRuns = map[string]*coalescedRun{}
+)
+
+// Key of the jobs yielding the same result : same command, runner type, input, working directory and environment
+func coalesceKey(job jobConfig) string {
+	names := make([]string, 0, len(job.Env))
+	for name := range job.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, field := range []string{job.Command, job.Type, job.Input, job.Workdir} {
+		hash.Write([]byte(field))
+		hash.Write([]byte{0})
+	}
+	for _, name := range names {
+		hash.Write([]byte(name + "=" + job.Env[name]))
+		hash.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Run a job, unless an identical one is already running, in which case its result is waited for and shared
+func runCoalesced(ctx context.Context, job jobConfig, run func() runResult) runResult {
+	if !coalescedCommands[job.Command] {
+		return run()
+	}
+	key := coalesceKey(job)
+
+	coalesceMu.Lock()
+	if leading, ok := coalescedRuns[key]; ok {
+		coalesceMu.Unlock()
+		runLog(job).Println("Run", job.ID, "joins the identical run", leading.leader)
+
+		// The leader holds a slot for both of them
+		if limits != nil {
+			limits.park()
+		}
+		cancelled := false
+		select {
+		case <-leading.done:
+		case <-ctx.Done():
+			cancelled = true
+		}
+
+		// A cancellation of the leader does not apply to the jobs which joined it
+		rerun := !cancelled && leading.result.Cancelled
+		if limits != nil {
+			limits.unpark(rerun)
+		}
+		switch {
+		case cancelled:
+			// There is no process of its own to stop
+			return runResult{Success: false, Output: "null", Cancelled: true, Graceful: true, Reason: "cancelled"}
+		case rerun:
+			return run()
+		}
+		return copyResult(leading.result)
+	}
+
+	leading := &coalescedRun{leader: job.ID, done: make(chan struct{})}
+	coalescedRuns[key] = leading
+	coalesceMu.Unlock()
+
+	leading.result = run()
+
+	coalesceMu.Lock()
+	delete(coalescedRuns, key)
+	coalesceMu.Unlock()
+	close(leading.done)
+
+	return leading.result
+}
+
+// Copy of a result sharing none of its slices and maps, so the jobs sharing it can each amend their own
+func copyResult(result runResult) runResult {
+	if result.ExitCode != nil {
+		exitCode := *result.ExitCode
+		result.ExitCode = &exitCode
+	}
+	result.AttemptTimeouts = append([]int(nil), result.AttemptTimeouts...)
+	result.Warnings = append([]string(nil), result.Warnings...)
+	result.TruncatedStreams = append([]string(nil), result.TruncatedStreams...)
+	if result.Metadata != nil {
+		metadata := make(map[string]string, len(result.Metadata))
+		for name, value := range result.Metadata {
+			metadata[name] = value
+		}
+		result.Metadata = metadata
+	}
+
+	return result
+}
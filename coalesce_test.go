@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRunCoalesced(t *testing.T) {
+	defer func(commands map[string]bool, saved *concurrencyLimits) {
+		coalescedCommands, limits = commands, saved
+	}(coalescedCommands, limits)
+	coalescedCommands = map[string]bool{"report": true}
+	limits = newConcurrencyLimits(2, 2)
+
+	exitCode := 0
+	release := make(chan struct{})
+	leaderRun := func() runResult {
+		<-release
+		return runResult{
+			Success:  true,
+			Output:   `"report"`,
+			ExitCode: &exitCode,
+			Warnings: []string{"slow"},
+			Metadata: map[string]string{"rows": "12"},
+		}
+	}
+	joinerRun := func() runResult {
+		t.Error("the joining job ran its own command")
+		return runResult{}
+	}
+
+	// Both jobs hold a slot, as the poll loop gives them
+	limits.acquire()
+	limits.acquire()
+	leader := make(chan runResult)
+	go func() {
+		defer limits.release()
+		leader <- runCoalesced(context.Background(), jobConfig{ID: "leader", Command: "report"}, leaderRun)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	joiner := make(chan runResult)
+	go func() {
+		defer limits.release()
+		joiner <- runCoalesced(context.Background(), jobConfig{ID: "joiner", Command: "report"}, joinerRun)
+	}()
+
+	// The joining job gives its slot back while it waits
+	deadline := time.Now().Add(2 * time.Second)
+	for running, _ := limits.status(); running != 1; running, _ = limits.status() {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d running jobs while one waits for the other, want 1", running)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(release)
+	leaderResult, joinerResult := <-leader, <-joiner
+	if !joinerResult.Success || joinerResult.Output != `"report"` || *joinerResult.ExitCode != 0 {
+		t.Errorf("got joiner result %+v", joinerResult)
+	}
+
+	// Each job owns its result
+	joinerResult.Warnings[0] = "amended"
+	joinerResult.Metadata["rows"] = "0"
+	*joinerResult.ExitCode = 1
+	if leaderResult.Warnings[0] != "slow" || leaderResult.Metadata["rows"] != "12" || *leaderResult.ExitCode != 0 {
+		t.Errorf("amending the joiner's result changed the leader's : %+v", leaderResult)
+	}
+
+	limits.waitIdle()
+}
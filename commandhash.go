@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Whether polls only carry a hash of the command list once the API acknowledged it
+var commandsHashing bool
+
+var commandsHashMu sync.Mutex
+
+// Hash of the command list the API confirmed it knows, through the X-Commands-Hash response header
+var acknowledgedCommandsHash string
+
+func commandsHash(commands string) string {
+	sum := sha256.Sum256([]byte(commands))
+	return hex.EncodeToString(sum[:])
+}
+
+// Build the poll payload, carrying the full command list unless only its hash is needed, and the local queue status
+func pollPayload(commands string, hash string, hashOnly bool) string {
+	fields := []string{}
+	if !commandsHashing || !hashOnly {
+		fields = append(fields, fmt.Sprintf("\"commands\": %s", commands))
+
+		// Nested under its own key, which older servers ignore
+		if caps := currentCapabilities(); caps != "" {
+			fields = append(fields, fmt.Sprintf("\"capabilities\": %s", caps))
+		}
+	}
+	if commandsHashing {
+		fields = append(fields, fmt.Sprintf("\"commands_hash\": %q", hash))
+	}
+
+	// Lets the API notice a runner falling behind, and stop sending it work
+	depth, oldest := queue.status(time.Now())
+	fields = append(fields, fmt.Sprintf("\"queue_depth\": %d", depth), fmt.Sprintf("\"oldest_queued_ms\": %d", oldest.Milliseconds()))
+
+	// Lets the API spot runners configured unlike the rest of their fleet
+	if reportConfigFingerprint {
+		fields = append(fields, fmt.Sprintf("\"config_fingerprint\": %q", configFingerprint))
+	}
+
+	// Lets the API route jobs on the agent's region, pool and such
+	if len(labels) > 0 {
+		// Maps of strings always encode
+		encoded, _ := json.Marshal(labels)
+		fields = append(fields, fmt.Sprintf("\"labels\": %s", encoded))
+	}
+
+	// Lets operators spot crash-looping runners. Restarts are only counted with a state directory
+	fields = append(fields, fmt.Sprintf("\"uptime_s\": %d", int64(uptime().Seconds())))
+	if stateDir != "" {
+		fields = append(fields, fmt.Sprintf("\"restart_count\": %d", restartCount))
+	}
+
+	return "{" + strings.Join(fields, ", ") + "}"
+}
+
+// Whether the API acknowledged this command list hash. Servers which never do keep receiving the full list
+func commandsHashAcknowledged(hash string) bool {
+	commandsHashMu.Lock()
+	defer commandsHashMu.Unlock()
+
+	return commandsHashing && acknowledgedCommandsHash == hash
+}
+
+func acknowledgeCommandsHash(hash string) {
+	commandsHashMu.Lock()
+	defer commandsHashMu.Unlock()
+
+	acknowledgedCommandsHash = hash
+}
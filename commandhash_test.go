@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPollPayloadRestartCount(t *testing.T) {
+	defer func(dir string, count int) { stateDir, restartCount = dir, count }(stateDir, restartCount)
+	restartCount = 3
+
+	for _, dir := range []string{"", t.TempDir()} {
+		stateDir = dir
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal([]byte(pollPayload(`["echo"]`, "", false)), &fields); err != nil {
+			t.Fatal(err)
+		}
+
+		count, sent := fields["restart_count"]
+		if sent != (dir != "") {
+			t.Errorf("with state dir %q, got restart_count sent %v", dir, sent)
+		}
+		if sent && string(count) != "3" {
+			t.Errorf("got restart_count %s, want 3", count)
+		}
+		if _, ok := fields["uptime_s"]; !ok {
+			t.Errorf("with state dir %q, got no uptime_s", dir)
+		}
+	}
+}
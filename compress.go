@@ -0,0 +1,26 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+)
+
+// Whether the notify payloads over compressThreshold are sent gzipped, for the servers which decode them
+var compressNotify = true
+
+// Size of a notify payload in bytes past which it is compressed, smaller ones are not worth the overhead
+var compressThreshold = 64 * 1024
+
+// Compress a payload, sent with Content-Encoding: gzip
+func gzipPayload(payload []byte) ([]byte, error) {
+	compressed := new(bytes.Buffer)
+	writer := gzip.NewWriter(compressed)
+	if _, err := writer.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return compressed.Bytes(), nil
+}
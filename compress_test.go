@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestGzipPayload(t *testing.T) {
+	payload := []byte(strings.Repeat(`{"line": "compressible"}`, 1000))
+
+	compressed, err := gzipPayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= len(payload) {
+		t.Errorf("got %d compressed bytes out of %d", len(compressed), len(payload))
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, payload) {
+		t.Error("the decoded payload differs from the original one")
+	}
+}
+
+func TestNotifyCompression(t *testing.T) {
+	defer func(enabled bool, threshold int) {
+		compressNotify, compressThreshold = enabled, threshold
+	}(compressNotify, compressThreshold)
+	compressThreshold = 1024
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		logs     string
+		encoding string
+	}{
+		{"large", true, strings.Repeat("a log line\n", 1000), "gzip"},
+		{"small", true, "a log line\n", ""},
+		{"disabled", false, strings.Repeat("a log line\n", 1000), ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			compressNotify = test.enabled
+			api := newFakeAPI(t)
+			job := jobConfig{ID: "z-" + test.name, Command: "echo"}
+			result := runResult{Success: true, Output: `{"ok": true}`, Logs: test.logs}
+
+			if err := api.agent().notify(context.Background(), api.URL, job, result); err != nil {
+				t.Fatal(err)
+			}
+
+			// The fake API decodes gzipped bodies
+			request := api.requestsTo("/notify")[0]
+			if encoding := request.Header.Get("Content-Encoding"); encoding != test.encoding {
+				t.Errorf("got Content-Encoding %q, want %q", encoding, test.encoding)
+			}
+			payload, err := notifyPayload(job, result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(request.Body, payload) {
+				t.Errorf("got payload %.100q, want %.100q", request.Body, payload)
+			}
+		})
+	}
+}
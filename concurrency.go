@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Concurrency regimes, depending on the number of running jobs
+const (
+	regimeNormal    = "normal"
+	regimeOverSoft  = "over-soft"
+	regimeSaturated = "saturated"
+)
+
+// Limits of the agent's jobs, nil until the agent starts claiming
+var limits *concurrencyLimits
+
+// Tracks running jobs against a soft limit (normal operating concurrency) and a hard limit (absolute max)
+type concurrencyLimits struct {
+	mu      sync.Mutex
+	freed   *sync.Cond
+	soft    int
+	hard    int
+	running int
+
+	// Jobs waiting for the result of an identical run, which do not take a slot meanwhile
+	parked int
+}
+
+func newConcurrencyLimits(soft int, hard int) *concurrencyLimits {
+	limits := &concurrencyLimits{
+		soft: soft,
+		hard: hard,
+	}
+	limits.freed = sync.NewCond(&limits.mu)
+
+	return limits
+}
+
+// Block until the hard limit leaves room for another job
+func (c *concurrencyLimits) waitForSlot() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.running >= c.hard {
+		c.freed.Wait()
+	}
+}
+
+// Count a job as running. Between the soft and the hard limits the job is accepted, but it is logged
+func (c *concurrencyLimits) acquire() {
+	c.mu.Lock()
+	c.running++
+	c.mu.Unlock()
+
+	if running, regime := c.status(); regime != regimeNormal {
+		agentLog.Warnf("Over soft capacity (%s) : %d running jobs, soft limit %d, hard limit %d\n", regime, running, c.soft, c.hard)
+	}
+}
+
+func (c *concurrencyLimits) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.running--
+	c.freed.Broadcast()
+}
+
+// Give back the slot of a running job while it waits for another run, the job still being waited for by waitIdle
+func (c *concurrencyLimits) park() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.running--
+	c.parked++
+	c.freed.Broadcast()
+}
+
+// Count a parked job as running again. When it is to run its command, it first waits for the hard limit to leave
+// room for it
+func (c *concurrencyLimits) unpark(run bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for run && c.running >= c.hard {
+		c.freed.Wait()
+	}
+	c.parked--
+	c.running++
+}
+
+// Block until no job is running or parked anymore
+func (c *concurrencyLimits) waitIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.running > 0 || c.parked > 0 {
+		c.freed.Wait()
+	}
+}
+
+// Current number of running jobs, and the regime it puts the agent in
+func (c *concurrencyLimits) status() (int, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case c.running >= c.hard:
+		return c.running, regimeSaturated
+	case c.running > c.soft:
+		return c.running, regimeOverSoft
+	default:
+		return c.running, regimeNormal
+	}
+}
+
+// Semaphores of the commands limited by ZETTO_COMMAND_LIMITS, under the global limits. Built with the configuration
+// and only read afterwards, so it is safe to share between the jobs without a lock
+var commandSlots = map[string]chan struct{}{}
+
+// Parse per-command limits such as "heavy:2,light:20" into their semaphores
+func parseCommandLimits(spec string) (map[string]chan struct{}, error) {
+	slots := map[string]chan struct{}{}
+	if strings.TrimSpace(spec) == "" {
+		return slots, nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(entry, ":", 2)
+		command := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || command == "" {
+			return nil, fmt.Errorf("Invalid command limit %q", entry)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("Invalid limit of command %q, expected a positive integer", command)
+		}
+		slots[command] = make(chan struct{}, limit)
+	}
+
+	return slots, nil
+}
+
+// Limits of the limited commands
+func commandLimits() map[string]int {
+	limits := map[string]int{}
+	for command, slots := range commandSlots {
+		limits[command] = cap(slots)
+	}
+	return limits
+}
+
+// Command list without the commands whose slots are all taken, so the API does not hand out jobs which would have to
+// wait. The list is kept as is when no command is saturated or when it can not be parsed
+func availableCommands(commands string) string {
+	saturated := map[string]bool{}
+	for command, slots := range commandSlots {
+		if len(slots) == cap(slots) {
+			saturated[command] = true
+		}
+	}
+	if len(saturated) == 0 {
+		return commands
+	}
+
+	entries := []json.RawMessage{}
+	if err := json.Unmarshal([]byte(commands), &entries); err != nil {
+		return commands
+	}
+	available := []json.RawMessage{}
+	for _, entry := range entries {
+		var command listedCommand
+		if err := json.Unmarshal(entry, &command); err == nil && saturated[command.Name] {
+			continue
+		}
+		available = append(available, entry)
+	}
+
+	encoded, err := json.Marshal(available)
+	if err != nil {
+		return commands
+	}
+	return string(encoded)
+}
+
+// Wait for a slot of the job's command, rather than rejecting the job, and return the function releasing it. Returns
+// false if the context was cancelled meanwhile. Commands without a limit only count against the global ones
+func acquireCommandSlot(ctx context.Context, job jobConfig) (func(), bool) {
+	slots, ok := commandSlots[job.Command]
+	if !ok {
+		return func() {}, true
+	}
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		runLog(job).Println("Run", job.ID, "waiting for a slot of command", job.Command)
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+
+	return func() { <-slots }, true
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestAvailableCommands(t *testing.T) {
+	defer func(saved map[string]chan struct{}) { commandSlots = saved }(commandSlots)
+	commandSlots = map[string]chan struct{}{
+		"heavy": make(chan struct{}, 1),
+		"light": make(chan struct{}, 2),
+	}
+	commands := `["heavy", {"name": "light", "timeout": 30}, "other"]`
+
+	if got := availableCommands(commands); got != commands {
+		t.Errorf("without a saturated command got %s, want the list as is", got)
+	}
+
+	commandSlots["heavy"] <- struct{}{}
+	commandSlots["light"] <- struct{}{}
+	if got, want := availableCommands(commands), `[{"name":"light","timeout":30},"other"]`; got != want {
+		t.Errorf("with heavy saturated got %s, want %s", got, want)
+	}
+
+	commandSlots["light"] <- struct{}{}
+	if got, want := availableCommands(commands), `["other"]`; got != want {
+		t.Errorf("with heavy and light saturated got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings of the main loop, loaded by loadConfig
+var (
+	pollingInterval = 10 * time.Second
+
+	softConcurrency   = 1
+	hardConcurrency   = 1
+	concurrencyPerCPU = 1
+	startStagger      time.Duration
+
+	debounceDelay time.Duration
+	debounceKey   string
+
+	summaryCommands []string
+	summaryInterval = time.Minute
+	summarySize     = 100
+
+	resultCacheTTL  time.Duration
+	resultCacheSize = 1000
+
+	maxConcurrentPolls int
+)
+
+// Problems found while loading the configuration, reported all at once
+var configProblems []string
+
+func configProblem(name string, format string, args ...interface{}) {
+	configProblems = append(configProblems, fmt.Sprintf("%s : %s", name, fmt.Sprintf(format, args...)))
+}
+
+// Load the configuration from the environment and the optional ZETTO_CONFIG file, and validate all of it before
+// reporting every problem found
+func loadConfig() error {
+	configProblems = nil
+
+	// The file only fills the variables missing from the environment, the validation applies to the result
+	if path := os.Getenv("ZETTO_CONFIG"); path != "" {
+		if err := loadConfigFile(path); err != nil {
+			configProblem("ZETTO_CONFIG", "%v", err)
+		}
+	}
+
+	// Required settings. Agents authenticated by a client certificate may go without an API key
+	required := []string{"ZETTO_HOST", "ZETTO_RUNNER"}
+	if os.Getenv("ZETTO_CLIENT_CERT") == "" && os.Getenv("ZETTO_API_KEY_FILE") == "" {
+		required = append(required, "ZETTO_API_KEY")
+	}
+	for _, name := range required {
+		if os.Getenv(name) == "" {
+			configProblem(name, "missing")
+		}
+	}
+
+	// A key file takes precedence, keeping the key out of the agent's environment
+	apiKey = os.Getenv("ZETTO_API_KEY")
+	if path := os.Getenv("ZETTO_API_KEY_FILE"); path != "" {
+		key, err := readAPIKeyFile(path)
+		if err != nil {
+			configProblem("ZETTO_API_KEY_FILE", "%v", err)
+		}
+		apiKey = key
+	}
+
+	if host := os.Getenv("ZETTO_HOST"); host != "" {
+		if parsed, err := url.Parse(host); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			configProblem("ZETTO_HOST", "expected an http(s) URL, got %q", host)
+		}
+	}
+
+	for _, endpoint := range notifyEndpoints(os.Getenv("ZETTO_NOTIFY_ENDPOINTS")) {
+		if parsed, err := url.Parse(endpoint); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			configProblem("ZETTO_NOTIFY_ENDPOINTS", "expected http(s) URLs, got %q", endpoint)
+		}
+	}
+	if policy := os.Getenv("ZETTO_NOTIFY_POLICY"); policy != "" {
+		notifyPolicy = policy
+	}
+	if notifyPolicy != "all" && notifyPolicy != "any" && notifyPolicy != "quorum" {
+		configProblem("ZETTO_NOTIFY_POLICY", "expected all, any or quorum, got %q", notifyPolicy)
+	}
+
+	if runner := strings.Fields(os.Getenv("ZETTO_RUNNER")); len(runner) > 0 {
+		checkExecutable("ZETTO_RUNNER", runner[0])
+	}
+
+	runners, err := parseCommandRunners(os.Getenv("ZETTO_COMMAND_RUNNERS"))
+	if err != nil {
+		configProblem("ZETTO_COMMAND_RUNNERS", "%v", err)
+	}
+	commandRunners = runners
+	for _, set := range commandRunners {
+		for _, runner := range set.runners {
+			checkExecutable("ZETTO_COMMAND_RUNNERS", runner[0])
+		}
+	}
+
+	types, err := parseTypeRunners(os.Getenv("ZETTO_RUNNERS"))
+	if err != nil {
+		configProblem("ZETTO_RUNNERS", "%v", err)
+	}
+	typeRunners = types
+	for _, runner := range typeRunners {
+		checkExecutable("ZETTO_RUNNERS", runner[0])
+	}
+
+	if selection := os.Getenv("ZETTO_RUNNER_SELECTION"); selection != "" {
+		if selection != "round-robin" && selection != "least-loaded" {
+			configProblem("ZETTO_RUNNER_SELECTION", "expected round-robin or least-loaded, got %q", selection)
+		}
+		runnerSelection = selection
+	}
+
+	network := os.Getenv("ZETTO_SYSLOG_NETWORK")
+	if network == "" {
+		network = "udp"
+	}
+	facility := os.Getenv("ZETTO_SYSLOG_FACILITY")
+	if facility == "" {
+		facility = "daemon"
+	}
+	if err := initSyslog(network, os.Getenv("ZETTO_SYSLOG_ADDR"), facility); err != nil {
+		configProblem("ZETTO_SYSLOG_FACILITY", "%v", err)
+	}
+	syslogJobLogsEnabled = os.Getenv("ZETTO_SYSLOG_JOB_LOGS") == "true"
+
+	if format := os.Getenv("ZETTO_LOG_FORMAT"); format != "" {
+		logFormat = format
+	}
+	if logFormat != "text" && logFormat != "json" {
+		configProblem("ZETTO_LOG_FORMAT", "expected text or json, got %q", logFormat)
+	}
+	if patterns, err := parseRedactPatterns(os.Getenv("ZETTO_REDACT_PATTERNS")); err != nil {
+		configProblem("ZETTO_REDACT_PATTERNS", "%v", err)
+	} else {
+		redactPatterns = patterns
+	}
+	initLogging(logFormat, apiKey, proxyPassword(os.Getenv("ZETTO_PROXY_URL")))
+	switch level := os.Getenv("ZETTO_LOG_LEVEL"); level {
+	case "", "info":
+	case "debug":
+		debugLogs = true
+	default:
+		configProblem("ZETTO_LOG_LEVEL", "expected info or debug, got %q", level)
+	}
+
+	pushgatewayURL = os.Getenv("ZETTO_PUSHGATEWAY")
+	metricsAddr = os.Getenv("ZETTO_METRICS_ADDR")
+	healthAddr = os.Getenv("ZETTO_HEALTH_ADDR")
+	readyPollAge = envDuration("ZETTO_READY_POLL_AGE", readyPollAge)
+	readyPollFailures = envInt("ZETTO_READY_POLL_FAILURES", readyPollFailures)
+	if readyPollFailures < 1 {
+		configProblem("ZETTO_READY_POLL_FAILURES", "expected a positive integer, got %d", readyPollFailures)
+	}
+	busySignal = os.Getenv("ZETTO_BUSY_SIGNAL") == "true"
+	gracefulRestart = os.Getenv("ZETTO_GRACEFUL_RESTART") == "true"
+
+	if mqURL := os.Getenv("ZETTO_MQ_URL"); mqURL != "" {
+		client, err := newMQClient(mqURL)
+		if err != nil {
+			configProblem("ZETTO_MQ_URL", "%v", err)
+		}
+		mq = client
+		mqTopic = os.Getenv("ZETTO_MQ_TOPIC")
+		if mqTopic == "" {
+			configProblem("ZETTO_MQ_TOPIC", "required with ZETTO_MQ_URL")
+		}
+	}
+
+	spoolDir = os.Getenv("ZETTO_SPOOL_DIR")
+	if spoolDir != "" {
+		if err := os.MkdirAll(spoolDir, 0o700); err != nil {
+			configProblem("ZETTO_SPOOL_DIR", "%v", err)
+		}
+	}
+	spoolMaxBytes = envInt("ZETTO_SPOOL_MAX_BYTES", spoolMaxBytes)
+	spoolMaxFiles = envInt("ZETTO_SPOOL_MAX_FILES", spoolMaxFiles)
+	spoolReplayInterval = envDuration("ZETTO_SPOOL_REPLAY_INTERVAL", spoolReplayInterval)
+	if spoolReplayInterval <= 0 {
+		configProblem("ZETTO_SPOOL_REPLAY_INTERVAL", "expected a positive duration, got %v", spoolReplayInterval)
+	}
+	if policy := os.Getenv("ZETTO_SPOOL_OVERFLOW"); policy != "" {
+		spoolOverflow = policy
+	}
+	if spoolOverflow != "evict-oldest" && spoolOverflow != "backpressure" {
+		configProblem("ZETTO_SPOOL_OVERFLOW", "expected evict-oldest or backpressure, got %q", spoolOverflow)
+	}
+
+	isolateJobs = os.Getenv("ZETTO_ISOLATE_JOBS") == "true"
+	if isolateJobs && !isolationSupported() {
+		configProblem("ZETTO_ISOLATE_JOBS", "namespaces are only supported on Linux")
+	}
+
+	features = parseFeatures(os.Getenv("ZETTO_FEATURES"))
+
+	partialResults = os.Getenv("ZETTO_PARTIAL_RESULTS") == "true" || featureEnabled("partial-results")
+	if mode := os.Getenv("ZETTO_STREAM_DISCONNECT"); mode != "" {
+		streamDisconnect = mode
+	}
+	if streamDisconnect != "buffer" && streamDisconnect != "drop" {
+		configProblem("ZETTO_STREAM_DISCONNECT", "expected buffer or drop, got %q", streamDisconnect)
+	}
+
+	streamLogs = os.Getenv("ZETTO_STREAM_LOGS") == "true"
+	logStreamInterval = envDuration("ZETTO_LOG_STREAM_INTERVAL", logStreamInterval)
+	if logStreamInterval <= 0 {
+		configProblem("ZETTO_LOG_STREAM_INTERVAL", "expected a positive duration, got %v", logStreamInterval)
+	}
+
+	compressNotify = os.Getenv("ZETTO_COMPRESS") != "false"
+	compressThreshold = envInt("ZETTO_COMPRESS_THRESHOLD", compressThreshold)
+	if compressThreshold < 0 {
+		configProblem("ZETTO_COMPRESS_THRESHOLD", "expected a positive number of bytes, got %d", compressThreshold)
+	}
+
+	heartbeatInterval = envDuration("ZETTO_HEARTBEAT_INTERVAL", heartbeatInterval)
+	runControlInterval = envDuration("ZETTO_RUN_CONTROL_INTERVAL", runControlInterval)
+	initFDGuard()
+	initCgroups(os.Getenv("ZETTO_CGROUP_PARENT"))
+
+	if spec := os.Getenv("ZETTO_JOB_CPUSET"); spec != "" {
+		cpus, err := parseCPUSet(spec)
+		if err != nil {
+			configProblem("ZETTO_JOB_CPUSET", "%v, expected CPUs such as 0-3,8", err)
+		}
+		jobCPUSet = cpus
+	}
+	cpuSets, err := parseCommandCPUSets(os.Getenv("ZETTO_COMMAND_CPUSETS"))
+	if err != nil {
+		configProblem("ZETTO_COMMAND_CPUSETS", "%v, expected entries such as build:0-3,8;deploy:4", err)
+	}
+	commandCPUSets = cpuSets
+	if !affinitySupported && (jobCPUSet != nil || len(commandCPUSets) > 0) {
+		agentLog.Warnf("CPU affinity is not supported on this platform, ignoring ZETTO_JOB_CPUSET and ZETTO_COMMAND_CPUSETS\n")
+	}
+
+	resultCacheTTL = envDuration("ZETTO_RESULT_CACHE_TTL", resultCacheTTL)
+	resultCacheSize = envInt("ZETTO_RESULT_CACHE_SIZE", resultCacheSize)
+	if resultCacheSize < 1 {
+		configProblem("ZETTO_RESULT_CACHE_SIZE", "expected a positive integer, got %d", resultCacheSize)
+	}
+
+	maxConcurrentPolls = envInt("ZETTO_MAX_CONCURRENT_POLLS", maxConcurrentPolls)
+	if maxConcurrentPolls < 0 {
+		configProblem("ZETTO_MAX_CONCURRENT_POLLS", "expected a non-negative integer, got %d", maxConcurrentPolls)
+	}
+
+	commandsHashing = os.Getenv("ZETTO_COMMANDS_HASH") == "true"
+
+	secretResolver = strings.Fields(os.Getenv("ZETTO_SECRET_RESOLVER"))
+	if len(secretResolver) > 0 {
+		checkExecutable("ZETTO_SECRET_RESOLVER", secretResolver[0])
+	}
+	revisionCommand = strings.Fields(os.Getenv("ZETTO_COMMAND_REVISION_COMMAND"))
+	if len(revisionCommand) > 0 {
+		checkExecutable("ZETTO_COMMAND_REVISION_COMMAND", revisionCommand[0])
+	}
+
+	verifyCommand = strings.Fields(os.Getenv("ZETTO_VERIFY_COMMAND"))
+	if len(verifyCommand) > 0 {
+		checkExecutable("ZETTO_VERIFY_COMMAND", verifyCommand[0])
+	}
+	verifyTimeout = envDuration("ZETTO_VERIFY_TIMEOUT", verifyTimeout)
+
+	transformCommand = strings.Fields(os.Getenv("ZETTO_TRANSFORM_COMMAND"))
+	if len(transformCommand) > 0 {
+		checkExecutable("ZETTO_TRANSFORM_COMMAND", transformCommand[0])
+	}
+	transformTimeout = envDuration("ZETTO_TRANSFORM_TIMEOUT", transformTimeout)
+	switch failure := os.Getenv("ZETTO_TRANSFORM_FAILURE"); failure {
+	case "", "open":
+		transformFailClosed = false
+	case "closed":
+		transformFailClosed = true
+	default:
+		configProblem("ZETTO_TRANSFORM_FAILURE", "expected open or closed, got %q", failure)
+	}
+
+	secretResolverTimeout = envDuration("ZETTO_SECRET_RESOLVER_TIMEOUT", secretResolverTimeout)
+
+	maxTimeout = envDuration("ZETTO_MAX_TIMEOUT", maxTimeout)
+
+	execRetries = envInt("ZETTO_EXEC_RETRIES", execRetries)
+	if value := os.Getenv("ZETTO_RETRY_TIMEOUT_MULTIPLIER"); value != "" {
+		multiplier, err := strconv.ParseFloat(value, 64)
+		if err != nil || multiplier < 1 {
+			configProblem("ZETTO_RETRY_TIMEOUT_MULTIPLIER", "expected a number >= 1, got %q", value)
+		} else {
+			retryTimeoutMultiplier = multiplier
+		}
+	}
+	multipliers, err := parseTimeoutMultipliers(os.Getenv("ZETTO_RETRY_TIMEOUT_MULTIPLIERS"))
+	if err != nil {
+		configProblem("ZETTO_RETRY_TIMEOUT_MULTIPLIERS", "%v, expected entries such as build:2 with multipliers >= 1", err)
+	}
+	retryTimeoutMultipliers = multipliers
+
+	// Per-command circuit breaking
+	if rate := os.Getenv("ZETTO_CIRCUIT_FAILURE_RATE"); rate != "" {
+		parsed, err := strconv.ParseFloat(rate, 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			configProblem("ZETTO_CIRCUIT_FAILURE_RATE", "expected a rate between 0 and 1, got %q", rate)
+		}
+		circuitFailureRate = parsed
+	}
+	rates, err := parseCommandValues(os.Getenv("ZETTO_CIRCUIT_FAILURE_RATES"), func(rate float64) bool { return rate >= 0 && rate <= 1 })
+	if err != nil {
+		configProblem("ZETTO_CIRCUIT_FAILURE_RATES", "%v, expected entries such as build:0.5 with rates between 0 and 1", err)
+	}
+	circuitFailureRates = rates
+	circuitWindow = envInt("ZETTO_CIRCUIT_WINDOW", circuitWindow)
+	circuitMinRuns = envInt("ZETTO_CIRCUIT_MIN_RUNS", circuitMinRuns)
+	if circuitWindow < 1 || circuitMinRuns < 1 || circuitMinRuns > circuitWindow {
+		configProblem("ZETTO_CIRCUIT_MIN_RUNS", "expected 1 <= ZETTO_CIRCUIT_MIN_RUNS <= ZETTO_CIRCUIT_WINDOW, got %d and %d", circuitMinRuns, circuitWindow)
+	}
+	circuitCooldown = envDuration("ZETTO_CIRCUIT_COOLDOWN", circuitCooldown)
+
+	defaultTimeout = envDuration("ZETTO_DEFAULT_TIMEOUT", defaultTimeout)
+	listTimeout = envDuration("ZETTO_LIST_TIMEOUT", listTimeout)
+	listRetries = envInt("ZETTO_LIST_RETRIES", listRetries)
+
+	notifyRetries = envInt("ZETTO_NOTIFY_RETRIES", notifyRetries)
+	notifyRetryDelay = envDuration("ZETTO_NOTIFY_RETRY_DELAY", notifyRetryDelay)
+	notifyRetryMaxDelay = envDuration("ZETTO_NOTIFY_RETRY_MAX_DELAY", notifyRetryMaxDelay)
+
+	notifyJitter = envDuration("ZETTO_NOTIFY_JITTER", notifyJitter)
+
+	relistJitter = envDuration("ZETTO_RELIST_JITTER", relistJitter)
+	relistInterval = envDuration("ZETTO_RELIST_INTERVAL", relistInterval)
+
+	httpTimeout = envDuration("ZETTO_HTTP_TIMEOUT", httpTimeout)
+	notifyTimeout = envDuration("ZETTO_NOTIFY_TIMEOUT", notifyTimeout)
+	longPoll = os.Getenv("ZETTO_LONG_POLL") == "true"
+	longPollHold = envDuration("ZETTO_LONG_POLL_HOLD", longPollHold)
+	followRedirects = envInt("ZETTO_FOLLOW_REDIRECTS", followRedirects)
+
+	tlsMinVersion, err := parseTLSVersion(os.Getenv("ZETTO_TLS_MIN_VERSION"))
+	if err != nil {
+		configProblem("ZETTO_TLS_MIN_VERSION", "%v", err)
+	}
+	tlsCipherSuites, err := parseCipherSuites(os.Getenv("ZETTO_TLS_CIPHER_SUITES"))
+	if err != nil {
+		configProblem("ZETTO_TLS_CIPHER_SUITES", "%v", err)
+	}
+	if len(tlsCipherSuites) > 0 && tlsMinVersion == tlsVersions["1.3"] {
+		configProblem("ZETTO_TLS_CIPHER_SUITES", "cipher suites can not be restricted when only TLS 1.3 is allowed")
+	}
+	// Certificates are loaded once, here, rather than for each call
+	clientCertificates, err := loadClientCertificate(os.Getenv("ZETTO_CLIENT_CERT"), os.Getenv("ZETTO_CLIENT_KEY"))
+	if err != nil {
+		configProblem("ZETTO_CLIENT_CERT", "%v", err)
+	}
+	caCertificates, err := loadCACertificates(os.Getenv("ZETTO_CA_CERT"))
+	if err != nil {
+		configProblem("ZETTO_CA_CERT", "%v", err)
+	}
+	configureTLS(tlsMinVersion, tlsCipherSuites, clientCertificates, caCertificates)
+
+	proxy, err := parseProxyURL(os.Getenv("ZETTO_PROXY_URL"))
+	if err != nil {
+		configProblem("ZETTO_PROXY_URL", "%v", err)
+	}
+	configureProxy(proxy)
+
+	startRetries = envInt("ZETTO_START_RETRIES", startRetries)
+	startRetryDelay = envDuration("ZETTO_START_RETRY_DELAY", startRetryDelay)
+
+	if actions, ok := os.LookupEnv("ZETTO_NOTIFY_ACTIONS"); ok {
+		notifyActions = parseNotifyActions(actions)
+	}
+
+	killGrace = envDuration("ZETTO_KILL_GRACE", killGrace)
+
+	maxOutputBytes = envInt("ZETTO_MAX_OUTPUT_BYTES", maxOutputBytes)
+	maxStdoutBytes = envInt("ZETTO_MAX_STDOUT_BYTES", maxOutputBytes)
+	maxStderrBytes = envInt("ZETTO_MAX_STDERR_BYTES", maxOutputBytes)
+
+	captureStallTimeout = envDuration("ZETTO_CAPTURE_STALL_TIMEOUT", captureStallTimeout)
+	if mode := os.Getenv("ZETTO_HELD_PIPES"); mode != "" {
+		heldPipesMode = mode
+	}
+	if heldPipesMode != "fail" && heldPipesMode != "proceed" {
+		configProblem("ZETTO_HELD_PIPES", "expected fail or proceed, got %q", heldPipesMode)
+	}
+	// The stall timeout is the command's WaitDelay, past which exec kills it whatever the grace period
+	if captureStallTimeout > 0 && killGrace >= captureStallTimeout {
+		configProblem("ZETTO_KILL_GRACE", "expected less than ZETTO_CAPTURE_STALL_TIMEOUT (%s), got %s", captureStallTimeout, killGrace)
+	}
+
+	completeOnStdoutEOF = os.Getenv("ZETTO_COMPLETE_ON_STDOUT_EOF") == "true"
+	stdoutEOFGrace = envDuration("ZETTO_STDOUT_EOF_GRACE", stdoutEOFGrace)
+
+	loadExtractors()
+
+	if allowlist, ok := os.LookupEnv("ZETTO_ENV_ALLOWLIST"); ok {
+		envAllowlist = []string{}
+		for _, name := range strings.Split(allowlist, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				envAllowlist = append(envAllowlist, name)
+			}
+		}
+	}
+
+	if value := os.Getenv("ZETTO_SUCCESS_EXIT_CODES"); value != "" {
+		codes, err := parseExitCodes(value)
+		if err != nil {
+			configProblem("ZETTO_SUCCESS_EXIT_CODES", "%v", err)
+		} else {
+			successExitCodes = codes
+		}
+	}
+
+	if mode := os.Getenv("ZETTO_EMPTY_OUTPUT"); mode != "" {
+		emptyOutput = mode
+	}
+	switch emptyOutput {
+	case "raw", "null", "empty", "fail":
+	default:
+		configProblem("ZETTO_EMPTY_OUTPUT", "expected raw, null, empty or fail, got %q", emptyOutput)
+	}
+
+	if mode := os.Getenv("ZETTO_INPUT_MODE"); mode != "" {
+		inputMode = mode
+	}
+	if inputMode != inputModeArg && inputMode != inputModeFile && inputMode != inputModeStdin {
+		configProblem("ZETTO_INPUT_MODE", "expected %s, %s or %s, got %q", inputModeArg, inputModeFile, inputModeStdin, inputMode)
+	}
+	maxInputBytes = envInt("ZETTO_MAX_INPUT_BYTES", maxInputBytes)
+
+	workdir = os.Getenv("ZETTO_WORKDIR")
+	if workdir != "" {
+		if err := checkWorkdir(workdir); err != nil {
+			configProblem("ZETTO_WORKDIR", "%v", err)
+		}
+	}
+	tempWorkdir = os.Getenv("ZETTO_TEMP_WORKDIR") == "true"
+
+	normalizeNewlines = os.Getenv("ZETTO_NORMALIZE_NEWLINES") == "true"
+
+	allowedCommands = map[string]bool{}
+	for _, command := range strings.Split(os.Getenv("ZETTO_ALLOWED_COMMANDS"), ",") {
+		if command = strings.TrimSpace(command); command != "" {
+			allowedCommands[command] = true
+		}
+	}
+
+	coalescedCommands = map[string]bool{}
+	for _, command := range strings.Split(os.Getenv("ZETTO_COALESCE_IDENTICAL"), ",") {
+		if command = strings.TrimSpace(command); command != "" {
+			coalescedCommands[command] = true
+		}
+	}
+
+	jsonOutputCommands = map[string]bool{}
+	for _, command := range strings.Split(os.Getenv("ZETTO_JSON_OUTPUT_COMMANDS"), ",") {
+		if command = strings.TrimSpace(command); command != "" {
+			jsonOutputCommands[command] = true
+		}
+	}
+	requireJSONOutput = os.Getenv("ZETTO_REQUIRE_JSON_OUTPUT") == "true"
+
+	if commands := os.Getenv("ZETTO_SUMMARY_COMMANDS"); commands != "" {
+		summaryCommands = strings.Split(commands, ",")
+	}
+	summaryInterval = envDuration("ZETTO_SUMMARY_INTERVAL", summaryInterval)
+	summarySize = envInt("ZETTO_SUMMARY_SIZE", summarySize)
+
+	pollingInterval = envDuration("ZETTO_POLLING_INTERVAL", pollingInterval)
+	if value := os.Getenv("ZETTO_POLL_JITTER"); value != "" {
+		jitter, err := strconv.ParseFloat(value, 64)
+		if err != nil || jitter < 0 {
+			configProblem("ZETTO_POLL_JITTER", "expected a number >= 0, got %q", value)
+		} else {
+			pollJitter = jitter
+		}
+	}
+	maxPollBackoff = envDuration("ZETTO_MAX_POLL_BACKOFF", maxPollBackoff)
+	maxUnreachableBackoff = envDuration("ZETTO_MAX_UNREACHABLE_BACKOFF", maxUnreachableBackoff)
+	maxPollFailures = envInt("ZETTO_MAX_POLL_FAILURES", maxPollFailures)
+	recoverySpread = envDuration("ZETTO_RECOVERY_SPREAD", recoverySpread)
+
+	// Soft and hard concurrency limits : over the soft one jobs are still accepted, the hard one stops claiming.
+	// ZETTO_CONCURRENCY sets both. Without any of them, as many jobs as CPUs times ZETTO_CONCURRENCY_PER_CPU are run
+	concurrencyPerCPU = envInt("ZETTO_CONCURRENCY_PER_CPU", concurrencyPerCPU)
+	if concurrencyPerCPU < 1 {
+		configProblem("ZETTO_CONCURRENCY_PER_CPU", "expected a positive integer, got %d", concurrencyPerCPU)
+		concurrencyPerCPU = 1
+	}
+	softConcurrency = runtime.NumCPU() * concurrencyPerCPU
+	softConcurrency = envInt("ZETTO_CONCURRENCY", softConcurrency)
+	softConcurrency = envInt("ZETTO_SOFT_CONCURRENCY", envInt("ZETTO_HARD_CONCURRENCY", softConcurrency))
+	hardConcurrency = envInt("ZETTO_HARD_CONCURRENCY", softConcurrency)
+	if softConcurrency < 1 || hardConcurrency < softConcurrency {
+		configProblem("ZETTO_SOFT_CONCURRENCY", "expected 1 <= ZETTO_SOFT_CONCURRENCY <= ZETTO_HARD_CONCURRENCY, got %d and %d", softConcurrency, hardConcurrency)
+	}
+
+	if parsed, err := parseLabels(os.Getenv("ZETTO_LABELS")); err != nil {
+		configProblem("ZETTO_LABELS", "%v", err)
+	} else {
+		labels = parsed
+	}
+
+	slots, err := parseCommandLimits(os.Getenv("ZETTO_COMMAND_LIMITS"))
+	if err != nil {
+		configProblem("ZETTO_COMMAND_LIMITS", "%v", err)
+	} else {
+		commandSlots = slots
+	}
+
+	startStagger = envDuration("ZETTO_START_STAGGER", startStagger)
+	maxJobsPerMinute = envInt("ZETTO_MAX_JOBS_PER_MINUTE", maxJobsPerMinute)
+	if maxJobsPerMinute < 0 {
+		configProblem("ZETTO_MAX_JOBS_PER_MINUTE", "expected a positive integer, got %d", maxJobsPerMinute)
+	}
+
+	debounceDelay = envDuration("ZETTO_DEBOUNCE", debounceDelay)
+	debounceKey = os.Getenv("ZETTO_DEBOUNCE_KEY")
+	// Keyed on the whole input, jobs for the same target with different payloads would never supersede each other
+	if debounceDelay > 0 && debounceKey == "" {
+		configProblem("ZETTO_DEBOUNCE_KEY", "required with ZETTO_DEBOUNCE, the input field naming the target of a job")
+	}
+
+	if product := os.Getenv("ZETTO_USER_AGENT"); product != "" {
+		if strings.ContainsAny(product, " \t/()") {
+			configProblem("ZETTO_USER_AGENT", "expected a product name such as my-agent, got %q", product)
+		}
+		userAgentProduct = product
+	}
+
+	preflightEnabled = os.Getenv("ZETTO_PREFLIGHT") == "true"
+	dryRun = os.Getenv("ZETTO_DRY_RUN") == "true"
+	if path := os.Getenv("ZETTO_PREFLIGHT_PATH"); path != "" {
+		preflightPath = strings.TrimPrefix(path, "/")
+	}
+
+	stateDir = os.Getenv("ZETTO_STATE_DIR")
+
+	controlSocketPath = os.Getenv("ZETTO_CONTROL_SOCKET")
+	if size := envInt("ZETTO_EVENTS_SIZE", len(events.events)); size >= 0 {
+		events = newEventRing(size)
+	} else {
+		configProblem("ZETTO_EVENTS_SIZE", "expected a number >= 0, got %d", size)
+	}
+
+	richCapabilities = os.Getenv("ZETTO_RICH_CAPABILITIES") == "true"
+
+	lameDuckDuration = envDuration("ZETTO_LAME_DUCK", lameDuckDuration)
+	maxRuntime = envDuration("ZETTO_MAX_RUNTIME", maxRuntime)
+
+	queueStaleAfter = envDuration("ZETTO_QUEUE_STALE_AFTER", queueStaleAfter)
+
+	reportConfigFingerprint = os.Getenv("ZETTO_CONFIG_FINGERPRINT") == "true"
+	configFingerprint = computeConfigFingerprint()
+
+	if len(configProblems) > 0 {
+		return fmt.Errorf("Invalid configuration :\n  - %s", strings.Join(configProblems, "\n  - "))
+	}
+
+	return nil
+}
+
+// Report a command which can not be found or executed
+func checkExecutable(name string, path string) {
+	if _, err := exec.LookPath(path); err != nil {
+		configProblem(name, "runner %q can not be executed (%v)", path, err)
+	}
+}
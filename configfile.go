@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Load the settings of a JSON or YAML file into the environment, where loadConfig reads them. The variables set in
+// the environment take precedence. Keys are either the names of the variables, such as ZETTO_HOST, or the same
+// without the prefix in any case, such as host
+func loadConfigFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var settings map[string]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		settings, err = parseYAMLSettings(content)
+	default:
+		settings, err = parseJSONSettings(content)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not parse %s : %v", path, err)
+	}
+
+	for key, value := range settings {
+		name := strings.ToUpper(key)
+		if !strings.HasPrefix(name, "ZETTO_") {
+			name = "ZETTO_" + name
+		}
+		if os.Getenv(name) != "" {
+			continue
+		}
+		if err := os.Setenv(name, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Parse a JSON object of settings, whose values may be strings, numbers, booleans or lists joined with commas
+func parseJSONSettings(content []byte) (map[string]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	var raw map[string]interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	settings := map[string]string{}
+	for key, value := range raw {
+		setting, err := settingString(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s : %v", key, err)
+		}
+		settings[key] = setting
+	}
+
+	return settings, nil
+}
+
+func settingString(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	case bool:
+		return fmt.Sprintf("%t", value), nil
+	case []interface{}:
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			setting, err := settingString(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, setting)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+}
+
+// Parse the flat subset of YAML used for settings : "key: value" lines, optionally quoted values, and comments
+func parseYAMLSettings(content []byte) (map[string]string, error) {
+	settings := map[string]string{}
+	for i, line := range strings.Split(string(content), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("line %d : nested values are not supported", i+1)
+		}
+
+		parts := strings.SplitN(trimmed, ":", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" {
+			return nil, fmt.Errorf("line %d : expected key: value", i+1)
+		}
+
+		value, err := yamlScalar(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d : %v", i+1, err)
+		}
+		settings[key] = value
+	}
+
+	return settings, nil
+}
+
+// Value of a YAML scalar, quoted or plain, without its trailing comment
+func yamlScalar(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	switch value[0] {
+	case '"':
+		end := strings.LastIndex(value, "\"")
+		if end == 0 {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+		var unquoted string
+		if err := json.Unmarshal([]byte(value[:end+1]), &unquoted); err != nil {
+			return "", err
+		}
+		return unquoted, nil
+	case '\'':
+		end := strings.LastIndex(value, "'")
+		if end == 0 {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+		return strings.ReplaceAll(value[1:end], "''", "'"), nil
+	}
+
+	if comment := strings.Index(value, " #"); comment >= 0 {
+		value = strings.TrimSpace(value[:comment])
+	}
+	return value, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+)
+
+// Path of the Unix socket serving the agent's local control endpoints, empty when disabled
+var controlSocketPath string
+
+// Serve the local control endpoints on the control socket
+func serveControlSocket() error {
+	// A socket left behind by a previous run would prevent listening, unless it is handed over by a graceful restart
+	if !reexecuted() {
+		if err := os.Remove(controlSocketPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	listener, inherited, err := listen("control", "unix", controlSocketPath)
+	if err != nil {
+		return err
+	}
+	if !inherited {
+		if err := os.Chmod(controlSocketPath, 0o600); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(events.recent())
+	})
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			agentLog.Errorf("Control socket stopped : %v\n", err)
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// A claimed job waiting for its debounce delay to elapse
+type debouncedJob struct {
+	job      jobConfig
+	deadline time.Time
+}
+
+// Holds claimed jobs for a short delay, so that a newer job for the same key supersedes the pending one
+type debouncer struct {
+	delay    time.Duration
+	keyField string
+	pending  map[string]*debouncedJob
+}
+
+func newDebouncer(delay time.Duration, keyField string) *debouncer {
+	return &debouncer{
+		delay:    delay,
+		keyField: keyField,
+		pending:  map[string]*debouncedJob{},
+	}
+}
+
+// Derive the debounce key of a job : its command and the configured input field, or its whole input when it lacks it
+func (d *debouncer) key(job jobConfig) string {
+	value := job.Input
+	if d.keyField != "" {
+		var input map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(job.Input), &input); err == nil {
+			if field, ok := input[d.keyField]; ok {
+				value = string(field)
+			}
+		}
+	}
+
+	sum := sha256.Sum256([]byte(value))
+	return job.Command + ":" + hex.EncodeToString(sum[:])
+}
+
+// Hold a job for the debounce delay, and return the pending job it supersedes if any
+func (d *debouncer) add(job jobConfig, now time.Time) *jobConfig {
+	key := d.key(job)
+	previous, found := d.pending[key]
+
+	// The delay restarts with every newer job, only the latest one will run
+	d.pending[key] = &debouncedJob{
+		job:      job,
+		deadline: now.Add(d.delay),
+	}
+
+	if !found {
+		return nil
+	}
+	return &previous.job
+}
+
+// Pop the jobs whose debounce delay elapsed
+func (d *debouncer) ready(now time.Time) []jobConfig {
+	jobs := []jobConfig{}
+	for key, pending := range d.pending {
+		if !now.Before(pending.deadline) {
+			jobs = append(jobs, pending.job)
+			delete(d.pending, key)
+		}
+	}
+
+	return jobs
+}
+
+// Pop every pending job, whatever its deadline
+func (d *debouncer) flush() []jobConfig {
+	jobs := []jobConfig{}
+	for key, pending := range d.pending {
+		jobs = append(jobs, pending.job)
+		delete(d.pending, key)
+	}
+
+	return jobs
+}
+
+// Time left until the next pending job is due, false if nothing is pending
+func (d *debouncer) nextDue(now time.Time) (time.Duration, bool) {
+	var next time.Duration
+	found := false
+	for _, pending := range d.pending {
+		left := pending.deadline.Sub(now)
+		if !found || left < next {
+			next = left
+			found = true
+		}
+	}
+
+	return next, found
+}
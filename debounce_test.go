@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDebounceSupersede(t *testing.T) {
+	debounce := newDebouncer(2*time.Second, "target")
+	now := time.Now()
+
+	first := jobConfig{ID: "first", Command: "deploy", Input: `{"target": "web", "sha": "a1"}`}
+	if superseded := debounce.add(first, now); superseded != nil {
+		t.Errorf("got %s superseded by the first job", superseded.ID)
+	}
+
+	// Same target with another payload
+	second := jobConfig{ID: "second", Command: "deploy", Input: `{"target": "web", "sha": "b2"}`}
+	if superseded := debounce.add(second, now.Add(time.Second)); superseded == nil || superseded.ID != "first" {
+		t.Errorf("got %v superseded, want the first job", superseded)
+	}
+
+	// Another target, or another command, does not supersede it
+	other := jobConfig{ID: "other", Command: "deploy", Input: `{"target": "api", "sha": "b2"}`}
+	if superseded := debounce.add(other, now.Add(time.Second)); superseded != nil {
+		t.Errorf("got %s superseded by another target", superseded.ID)
+	}
+	build := jobConfig{ID: "build", Command: "build", Input: `{"target": "web"}`}
+	if superseded := debounce.add(build, now.Add(time.Second)); superseded != nil {
+		t.Errorf("got %s superseded by another command", superseded.ID)
+	}
+
+	// The delay restarted with the second job
+	if ready := debounce.ready(now.Add(2 * time.Second)); len(ready) != 0 {
+		t.Errorf("got %d jobs ready before their delay", len(ready))
+	}
+	ready := map[string]bool{}
+	for _, job := range debounce.ready(now.Add(3 * time.Second)) {
+		ready[job.ID] = true
+	}
+	if len(ready) != 3 || !ready["second"] || !ready["other"] || !ready["build"] {
+		t.Errorf("got ready jobs %v", ready)
+	}
+}
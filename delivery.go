@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// How many notify endpoints must accept a result for it to be delivered : "all", "any" or "quorum" (a majority)
+var notifyPolicy = "all"
+
+// Number of endpoints which must accept a result under the notify policy
+func requiredDeliveries(endpoints int) int {
+	switch notifyPolicy {
+	case "any":
+		return 1
+	case "quorum":
+		return endpoints/2 + 1
+	default:
+		return endpoints
+	}
+}
+
+// Time the deliveries to the other endpoints are given in the background, once the notify policy is settled
+var lateDeliveryTimeout = 2 * time.Minute
+
+// Deliver a run's result to every notify endpoint, each with its own retries, succeeding as the notify policy
+// requires. Returns as soon as the policy is met, or can not be anymore, the other deliveries going on in the
+// background for up to lateDeliveryTimeout. On failure the error of a failed endpoint is returned
+func (a *Agent) deliverResult(job jobConfig, result runResult) error {
+	switch len(a.NotifyEndpoints) {
+	case 0:
+		return a.notifyWithRetries(context.Background(), a.BaseURL, job, result)
+	case 1:
+		return a.notifyWithRetries(context.Background(), a.NotifyEndpoints[0], job, result)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, len(a.NotifyEndpoints))
+	for _, endpoint := range a.NotifyEndpoints {
+		go func(endpoint string) {
+			err := a.notifyWithRetries(ctx, endpoint, job, result)
+			runLog(job).Debugf("Delivery of run %s to %s : %v\n", job.ID, endpoint, err)
+			errs <- err
+		}(endpoint)
+	}
+
+	required := requiredDeliveries(len(a.NotifyEndpoints))
+	delivered, failed := 0, 0
+	var failure error
+	for delivered < required && len(a.NotifyEndpoints)-failed >= required {
+		// A result already recorded by an endpoint is as good as delivered to it
+		if err := <-errs; err == nil || errors.Is(err, errAlreadyCompleted) {
+			delivered++
+		} else {
+			failed++
+			if failure == nil {
+				failure = err
+			}
+		}
+	}
+
+	if pending := len(a.NotifyEndpoints) - delivered - failed; pending > 0 {
+		timer := time.AfterFunc(lateDeliveryTimeout, cancel)
+		go func() {
+			for ; pending > 0; pending-- {
+				<-errs
+			}
+			timer.Stop()
+			cancel()
+		}()
+	} else {
+		cancel()
+	}
+
+	if delivered >= required {
+		return nil
+	}
+	return failure
+}
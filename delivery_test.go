@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDeliverResultPolicies(t *testing.T) {
+	defer func(policy string, late time.Duration) {
+		notifyPolicy, lateDeliveryTimeout = policy, late
+	}(notifyPolicy, lateDeliveryTimeout)
+
+	fast, slow, rejecting := newFakeAPI(t), newFakeAPI(t), newFakeAPI(t)
+	// Hangs until the request is given up on
+	abandoned := make(chan struct{}, 2)
+	slow.handle("/notify", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			abandoned <- struct{}{}
+		case <-time.After(10 * time.Second):
+		}
+	})
+	rejecting.failNext("/notify", http.StatusBadRequest)
+
+	agent := fast.agent()
+	job := jobConfig{ID: "delivered", Command: "echo"}
+	result := runResult{Success: true, Output: `"ok"`}
+
+	// Any endpoint will do : the fast one settles it, the slow one is given up on in the background
+	notifyPolicy = "any"
+	lateDeliveryTimeout = 300 * time.Millisecond
+	agent.NotifyEndpoints = []string{slow.URL, fast.URL}
+	started := time.Now()
+	if err := agent.deliverResult(job, result); err != nil {
+		t.Errorf("any : got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("any : delivered after %s", elapsed)
+	}
+	select {
+	case <-abandoned:
+	case <-time.After(5 * time.Second):
+		t.Error("any : the slow delivery was not given up on")
+	}
+
+	// All endpoints must take it, a rejection settles it without waiting for the slow one
+	notifyPolicy = "all"
+	agent.NotifyEndpoints = []string{slow.URL, rejecting.URL, fast.URL}
+	started = time.Now()
+	if err := agent.deliverResult(job, result); classifyError(err) != errorClient {
+		t.Errorf("all : got %v, want the rejection", err)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("all : failed after %s", elapsed)
+	}
+
+	// A majority of them
+	notifyPolicy = "quorum"
+	rejecting.failNext("/notify", http.StatusBadRequest)
+	agent.NotifyEndpoints = []string{fast.URL, rejecting.URL, fast.URL}
+	if err := agent.deliverResult(job, result); err != nil {
+		t.Errorf("quorum : got %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Whether the agent only checks its setup then exits, with the runners, the commands list and a single poll, without
+// running any job
+var dryRun bool
+
+// Check the startup path as the agent would run it, and print a summary. Returns the exit code of the agent, non zero
+// if any check failed
+func (a *Agent) checkSetup() int {
+	failed := false
+	report := func(check string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Printf("FAILED %s : %v\n", check, err)
+			return
+		}
+		fmt.Printf("ok     %s\n", check)
+	}
+
+	// Only reached with a valid configuration, whose runners were found on the PATH and executable
+	report("configuration and runners", nil)
+
+	commands, err := a.getCommandsList()
+	report("commands list", err)
+	if err != nil {
+		return 1
+	}
+	fmt.Printf("       %d commands : %s\n", len(knownCommands(commands)), strings.TrimSpace(commands))
+
+	// A job claimed by the poll is handed back right away
+	job, err := a.poll(commands)
+	report("poll", err)
+	if job != nil {
+		report(fmt.Sprintf("handing back run %s", job.ID), a.nack(*job, "dry_run"))
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// Read an integer from the environment
+func envInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		configProblem(name, "expected an integer, got %q", value)
+		return defaultValue
+	}
+
+	return parsed
+}
+
+// Read a duration from the environment, either as a Go duration ("500ms", "2m") or as a number of seconds
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second))
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		configProblem(name, "expected a duration such as 30s or a number of seconds, got %q", value)
+		return defaultValue
+	}
+
+	return duration
+}
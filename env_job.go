@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// Agent environment variables forwarded to job commands, such as "PATH,HOME,LC_*". Nil forwards them all
+var envAllowlist []string
+
+// Whether an agent environment variable may be forwarded to job commands
+func envAllowed(name string) bool {
+	if envAllowlist == nil {
+		return true
+	}
+
+	for _, allowed := range envAllowlist {
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok && strings.HasPrefix(name, prefix) {
+			return true
+		}
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Environment of a job command : the allowed agent variables, overridden by the job's own. Values must never be logged
+func jobEnv(job jobConfig) []string {
+	env := []string{}
+	for _, entry := range os.Environ() {
+		name, _, _ := strings.Cut(entry, "=")
+		if _, overridden := job.Env[name]; overridden || !envAllowed(name) {
+			continue
+		}
+		env = append(env, entry)
+	}
+
+	for name, value := range job.Env {
+		env = append(env, name+"="+value)
+	}
+
+	return env
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Kinds of failed API requests, each calling for its own retries
+const (
+	// The API could not be reached at all, such as a refused connection or a failed DNS lookup : it is down, retry
+	// patiently
+	errorUnreachable = "unreachable"
+
+	// The API was reached but did not answer in time
+	errorTimeout = "timeout"
+
+	// The API failed to handle the request, with a 5xx or 429 response, it may handle it later
+	errorServer = "server"
+
+	// The API rejected the request, with another 4xx response, retrying will not help
+	errorClient = "client"
+
+	errorOther = "other"
+)
+
+// Upper bound of the delay between polls while the API can not be reached at all
+var maxUnreachableBackoff = 15 * time.Minute
+
+// Unexpected response status of an API request
+type statusError struct {
+	request string
+	status  int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("%s error %d", e.request, e.status)
+}
+
+// Kind of a failed API request's error
+func classifyError(err error) string {
+	var status statusError
+	if errors.As(err, &status) {
+		switch {
+		case status.status == http.StatusTooManyRequests || status.status >= 500:
+			return errorServer
+		case status.status >= 400:
+			return errorClient
+		default:
+			return errorOther
+		}
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return errorTimeout
+	}
+
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	if errors.As(err, &opErr) || errors.As(err, &dnsErr) {
+		return errorUnreachable
+	}
+
+	return errorOther
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}))
+	defer slow.Close()
+	_, timeoutErr := (&http.Client{Timeout: 50 * time.Millisecond}).Get(slow.URL)
+
+	// Nothing listens on the port of a closed listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedURL := "http://" + listener.Addr().String()
+	listener.Close()
+	_, refusedErr := http.Get(closedURL)
+
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer secure.Close()
+	// The default client does not trust the test certificate
+	_, tlsErr := http.Get(secure.URL)
+
+	dnsErr := fmt.Errorf("Polling : %w", &net.DNSError{Err: "no such host", Name: "api.invalid", IsNotFound: true})
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"timeout", timeoutErr, errorTimeout},
+		{"deadline", fmt.Errorf("Polling : %w", context.DeadlineExceeded), errorTimeout},
+		{"dns", dnsErr, errorUnreachable},
+		{"connection refused", refusedErr, errorUnreachable},
+		{"tls", tlsErr, errorOther},
+		{"not found", statusError{"Polling", http.StatusNotFound}, errorClient},
+		{"unauthorized", statusError{"Polling", http.StatusUnauthorized}, errorClient},
+		{"too many requests", statusError{"Polling", http.StatusTooManyRequests}, errorServer},
+		{"internal error", statusError{"Polling", http.StatusInternalServerError}, errorServer},
+		{"bad gateway", fmt.Errorf("Notifying : %w", statusError{"Notifying", http.StatusBadGateway}), errorServer},
+		{"redirect", statusError{"Polling", http.StatusFound}, errorOther},
+		{"other", errors.New("unexpected end of JSON input"), errorOther},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.err == nil {
+				t.Fatal("the request did not fail")
+			}
+			if got := classifyError(test.err); got != test.want {
+				t.Errorf("classifyError(%v) = %s, want %s", test.err, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Lifecycle event of a job, kept in memory for on-the-box debugging
+type jobEvent struct {
+	Time    time.Time `json:"time"`
+	RunID   string    `json:"run_id"`
+	Command string    `json:"command"`
+	Event   string    `json:"event"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// Bounded ring of the latest job events, the oldest ones being overwritten
+type eventRing struct {
+	mu     sync.Mutex
+	events []jobEvent
+	next   int
+	full   bool
+}
+
+var events = newEventRing(256)
+
+func newEventRing(size int) *eventRing {
+	return &eventRing{
+		events: make([]jobEvent, size),
+	}
+}
+
+func (r *eventRing) record(job jobConfig, event string, detail string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.events) == 0 {
+		return
+	}
+	r.events[r.next] = jobEvent{
+		Time:    time.Now(),
+		RunID:   job.ID,
+		Command: job.Command,
+		Event:   event,
+		Detail:  detail,
+	}
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Events held by the ring, oldest first
+func (r *eventRing) recent() []jobEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]jobEvent{}, r.events[:r.next]...)
+	}
+	return append(append([]jobEvent{}, r.events[r.next:]...), r.events[:r.next]...)
+}
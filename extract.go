@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Extractors configured through ZETTO_EXTRACT_<NAME>=pattern, by metadata field name
+var extractors = map[string]*regexp.Regexp{}
+
+// Read the ZETTO_EXTRACT_<NAME> variables, reporting invalid patterns
+func loadExtractors() {
+	extractors = map[string]*regexp.Regexp{}
+	for _, entry := range os.Environ() {
+		name, pattern, _ := strings.Cut(entry, "=")
+		if !strings.HasPrefix(name, "ZETTO_EXTRACT_") || name == "ZETTO_EXTRACT_" {
+			continue
+		}
+
+		extractor, err := regexp.Compile(pattern)
+		if err != nil {
+			configProblem(name, "invalid pattern (%v)", err)
+			continue
+		}
+		extractors[strings.ToLower(strings.TrimPrefix(name, "ZETTO_EXTRACT_"))] = extractor
+	}
+}
+
+// Extract metadata fields from the captured logs then output of a run. A field holds the first capture group
+// of its pattern's first match (or the whole match when the pattern has no group)
+func extractMetadata(logs string, output string) map[string]string {
+	if len(extractors) == 0 {
+		return nil
+	}
+
+	metadata := map[string]string{}
+	for field, extractor := range extractors {
+		for _, text := range []string{logs, output} {
+			match := extractor.FindStringSubmatch(text)
+			if match == nil {
+				continue
+			}
+			if len(match) > 1 {
+				metadata[field] = match[1]
+			} else {
+				metadata[field] = match[0]
+			}
+			break
+		}
+	}
+
+	if len(metadata) == 0 {
+		return nil
+	}
+	return metadata
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Request received by the fake API, with its body decompressed
+type recordedRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// Fake control plane for the tests : it hands out scripted jobs on /pop, answers scripted statuses, such as 429 or
+// 503, on any endpoint, and records every request. Endpoints without a script answer 200 with an empty object, /pop
+// answers 404 once out of jobs and /runs/<id>/control 404 unless the run was cancelled
+type fakeAPI struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	jobs      []string
+	statuses  map[string][]int
+	handlers  map[string]http.HandlerFunc
+	cancelled map[string]bool
+	requests  []recordedRequest
+
+	// Signalled on every request, for the tests waiting for one
+	received chan struct{}
+}
+
+func newFakeAPI(t *testing.T) *fakeAPI {
+	t.Helper()
+
+	api := &fakeAPI{
+		statuses:  map[string][]int{},
+		handlers:  map[string]http.HandlerFunc{},
+		cancelled: map[string]bool{},
+		received:  make(chan struct{}, 1),
+	}
+	api.Server = httptest.NewServer(http.HandlerFunc(api.serve))
+	t.Cleanup(api.Close)
+
+	return api
+}
+
+// Agent talking to the fake API
+func (f *fakeAPI) agent() *Agent {
+	return &Agent{
+		BaseURL:         f.URL,
+		APIKey:          "secret",
+		RunnerName:      "test",
+		UserAgent:       "zetto-agent/test",
+		Client:          f.Client(),
+		PollClient:      f.Client(),
+		NotifyClient:    f.Client(),
+		NotifyEndpoints: []string{f.URL},
+	}
+}
+
+// Queue jobs, as their JSON, handed out by /pop in order
+func (f *fakeAPI) addJobs(jobs ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.jobs = append(f.jobs, jobs...)
+}
+
+// Answer the next requests to path with these statuses, before going back to the default answer
+func (f *fakeAPI) failNext(path string, statuses ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statuses[path] = append(f.statuses[path], statuses...)
+}
+
+// Handle the requests to path, once their scripted statuses are exhausted
+func (f *fakeAPI) handle(path string, handler http.HandlerFunc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handlers[path] = handler
+}
+
+// Send a cancel directive on the control endpoint of a run
+func (f *fakeAPI) cancel(runID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cancelled[runID] = true
+}
+
+// Requests received so far on path
+func (f *fakeAPI) requestsTo(path string) []recordedRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	matching := []recordedRequest{}
+	for _, request := range f.requests {
+		if request.Path == path {
+			matching = append(matching, request)
+		}
+	}
+	return matching
+}
+
+// Wait for at least count requests on path, failing the test after the timeout
+func (f *fakeAPI) waitFor(t *testing.T, path string, count int, timeout time.Duration) []recordedRequest {
+	t.Helper()
+
+	deadline := time.After(timeout)
+	for {
+		if requests := f.requestsTo(path); len(requests) >= count {
+			return requests
+		}
+		select {
+		case <-f.received:
+		case <-deadline:
+			t.Fatalf("got %d requests to %s after %s, want %d", len(f.requestsTo(path)), path, timeout, count)
+		}
+	}
+}
+
+func (f *fakeAPI) serve(w http.ResponseWriter, r *http.Request) {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = reader
+	}
+	content, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	f.requests = append(f.requests, recordedRequest{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone(), Body: content})
+	var status int
+	if statuses := f.statuses[r.URL.Path]; len(statuses) > 0 {
+		status = statuses[0]
+		f.statuses[r.URL.Path] = statuses[1:]
+	}
+	handler := f.handlers[r.URL.Path]
+	var job string
+	if status == 0 && handler == nil && r.URL.Path == "/pop" && len(f.jobs) > 0 {
+		job = f.jobs[0]
+		f.jobs = f.jobs[1:]
+	}
+	runID, isControl := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/runs/"), "/control")
+	cancelled := isControl && f.cancelled[runID]
+	f.mu.Unlock()
+
+	select {
+	case f.received <- struct{}{}:
+	default:
+	}
+
+	switch {
+	case status != 0:
+		w.WriteHeader(status)
+	case handler != nil:
+		r.Body = io.NopCloser(bytes.NewReader(content))
+		handler(w, r)
+	case job != "":
+		io.WriteString(w, job)
+	case r.URL.Path == "/pop", isControl && !cancelled:
+		w.WriteHeader(http.StatusNotFound)
+	case cancelled:
+		io.WriteString(w, `{"action": "cancel"}`)
+	default:
+		io.WriteString(w, "{}")
+	}
+}
+
+// Decode the notify payloads received so far
+func (f *fakeAPI) notifies(t *testing.T) []jobNotify {
+	t.Helper()
+
+	notifies := []jobNotify{}
+	for _, request := range f.requestsTo("/notify") {
+		var notify jobNotify
+		if err := json.Unmarshal(request.Body, &notify); err != nil {
+			t.Fatalf("invalid notify payload %q : %v", request.Body, err)
+		}
+		notifies = append(notifies, notify)
+	}
+	return notifies
+}
+
+// Poll the fake API and run the job it hands out, as the main loop does, and fail the test if there is none
+func (f *fakeAPI) pollAndRun(t *testing.T, agent *Agent) jobConfig {
+	t.Helper()
+
+	job, err := agent.poll(`["echo"]`)
+	if err != nil {
+		t.Fatalf("poll failed : %v", err)
+	}
+	if job == nil {
+		t.Fatal("no job was handed out")
+	}
+	agent.runJob(context.Background(), *job)
+
+	return *job
+}
+
+func TestFakeAPILoop(t *testing.T) {
+	defer func(saved time.Duration) { notifyRetryDelay = saved }(notifyRetryDelay)
+	notifyRetryDelay = 10 * time.Millisecond
+
+	useRunner(t, `echo "{\"got\": $2}"`+"\n")
+	api := newFakeAPI(t)
+	agent := api.agent()
+
+	// Throttled, then failing, then a job
+	api.addJobs(`{"id": "loop-1", "command": "echo", "input": "1"}`)
+	api.failNext("/pop", http.StatusTooManyRequests, http.StatusServiceUnavailable)
+	for _, want := range []string{errorServer, errorServer} {
+		if _, err := agent.poll(`["echo"]`); classifyError(err) != want {
+			t.Fatalf("got poll error %v, want a %s error", err, want)
+		}
+	}
+
+	// The first notify fails, and is retried
+	api.failNext("/notify", http.StatusBadGateway)
+	api.pollAndRun(t, agent)
+
+	notifies := api.notifies(t)
+	if len(notifies) != 2 {
+		t.Fatalf("got %d notifies, want the failed one and its retry", len(notifies))
+	}
+	if notify := notifies[1]; notify.RunID != "loop-1" || !notify.Success || notify.Output != "{\"got\": 1}\n" {
+		t.Errorf("got notify %+v", notify)
+	}
+
+	// Out of jobs
+	if job, err := agent.poll(`["echo"]`); job != nil || err != nil {
+		t.Errorf("got job %v and error %v once out of jobs", job, err)
+	}
+	if header := api.requestsTo("/pop")[0].Header.Get("Authorization"); header != "ApiKey secret" {
+		t.Errorf("got Authorization header %q", header)
+	}
+}
+
+func TestAPIStatusHandling(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		// Class of the error, empty for none
+		pollErr   string
+		gotJob    bool
+		notifyErr string
+	}{
+		{"ok", http.StatusOK, "", true, ""},
+		{"not found", http.StatusNotFound, "", false, errorClient},
+		{"server error", http.StatusInternalServerError, errorServer, false, errorServer},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := newFakeAPI(t)
+			agent := api.agent()
+			api.addJobs(`{"id": "status-1", "command": "echo"}`)
+			if test.status != http.StatusOK {
+				api.failNext("/pop", test.status)
+				api.failNext("/notify", test.status)
+			}
+
+			job, err := agent.poll(`["echo"]`)
+			if test.pollErr == "" && err != nil || test.pollErr != "" && classifyError(err) != test.pollErr {
+				t.Errorf("poll : got error %v, want %q", err, test.pollErr)
+			}
+			if (job != nil) != test.gotJob {
+				t.Errorf("poll : got job %v", job)
+			}
+
+			err = agent.notify(context.Background(), api.URL, jobConfig{ID: "status-1", Command: "echo"}, runResult{Success: true, Output: `"ok"`})
+			if test.notifyErr == "" && err != nil || test.notifyErr != "" && classifyError(err) != test.notifyErr {
+				t.Errorf("notify : got error %v, want %q", err, test.notifyErr)
+			}
+
+			// Whatever the answer, every request identifies the runner
+			for _, path := range []string{"/pop", "/notify"} {
+				request := api.requestsTo(path)[0]
+				if header := request.Header.Get("Authorization"); header != "ApiKey secret" {
+					t.Errorf("%s : got Authorization header %q", path, header)
+				}
+				if header := request.Header.Get("X-Runner-Name"); header != "test" {
+					t.Errorf("%s : got X-Runner-Name header %q", path, header)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+)
+
+// Descriptors needed to run one more job : its pipes, plus the connections for its heartbeats and notify
+const fdsPerJob = 8
+
+// Under this soft limit a warning is logged at startup
+const lowFDLimit = 1024
+
+// Cap on the agent's open file descriptors, 0 when it can not be enforced
+var maxOpenFDs int
+
+// Resolve the file descriptors cap, from ZETTO_MAX_OPEN_FDS or by leaving some headroom under the soft limit
+func initFDGuard() {
+	softLimit, known := fdSoftLimit()
+	if known && softLimit < lowFDLimit {
+		agentLog.Warnf("Low open files limit (%d), consider raising it with ulimit -n\n", softLimit)
+	}
+
+	if os.Getenv("ZETTO_MAX_OPEN_FDS") != "" {
+		maxOpenFDs = envInt("ZETTO_MAX_OPEN_FDS", 0)
+	} else if known {
+		maxOpenFDs = softLimit - softLimit/10
+	}
+
+	if known && maxOpenFDs > softLimit {
+		agentLog.Warnf("ZETTO_MAX_OPEN_FDS (%d) is over the open files limit (%d)\n", maxOpenFDs, softLimit)
+	}
+}
+
+// Check whether there are enough file descriptors left to start another job
+func fdsAvailable() bool {
+	if maxOpenFDs <= 0 {
+		return true
+	}
+
+	open, known := openFDCount()
+	if !known {
+		return true
+	}
+
+	if open+fdsPerJob > maxOpenFDs {
+		agentLog.Warnf("Too many open files (%d, cap %d), backing off\n", open, maxOpenFDs)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Number of file descriptors currently open by the agent
+func openFDCount() (int, bool) {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, false
+	}
+
+	// Do not count the descriptor used to read the directory itself
+	return len(entries) - 1, true
+}
+
+// Soft limit on the number of open file descriptors
+func fdSoftLimit() (int, bool) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, false
+	}
+
+	return int(limit.Cur), true
+}
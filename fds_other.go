@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+// File descriptors usage is only tracked on Linux
+func openFDCount() (int, bool) {
+	return 0, false
+}
+
+func fdSoftLimit() (int, bool) {
+	return 0, false
+}
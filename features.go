@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+)
+
+// Experimental behaviors which can be turned on through ZETTO_FEATURES
+var knownFeatures = map[string]string{
+	"partial-results": "deliver checkpoint markers as partial results, same as ZETTO_PARTIAL_RESULTS",
+	"output-hash":     "send the SHA-256 of the command output, same as ZETTO_HASH_OUTPUT",
+}
+
+// Features enabled for this agent, parsed once at startup
+var features = map[string]bool{}
+
+// Parse a comma-separated list of features. Unknown ones are reported, but do not prevent the agent from starting
+func parseFeatures(list string) map[string]bool {
+	enabled := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		if _, ok := knownFeatures[name]; !ok {
+			agentLog.Warnf("Ignoring unknown feature %q\n", name)
+			continue
+		}
+		enabled[name] = true
+	}
+
+	return enabled
+}
+
+func featureEnabled(name string) bool {
+	return features[name]
+}
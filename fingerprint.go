@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Whether polls carry the fingerprint of the agent's configuration, for the API to spot runners configured unlike the
+// rest of their fleet
+var reportConfigFingerprint bool
+
+// Hash of the agent's configuration, computed whenever it is loaded
+var configFingerprint string
+
+// Settings left out of the fingerprint : secrets, and those telling processes apart rather than configuring them
+var unfingerprintedSettings = map[string]bool{
+	"ZETTO_API_KEY": true,
+	"ZETTO_LABELS":  true,
+}
+
+// Hash the ZETTO_ settings of the agent, in name order. Passwords of URLs are left out
+func computeConfigFingerprint() string {
+	settings := []string{}
+	for _, variable := range os.Environ() {
+		name, value, _ := strings.Cut(variable, "=")
+		if !strings.HasPrefix(name, "ZETTO_") || unfingerprintedSettings[name] {
+			continue
+		}
+		if parsed, err := url.Parse(value); err == nil && parsed.User != nil {
+			parsed.User = url.User(parsed.User.Username())
+			value = parsed.String()
+		}
+		settings = append(settings, name+"="+value)
+	}
+	sort.Strings(settings)
+
+	sum := sha256.Sum256([]byte(strings.Join(settings, "\n")))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Address of the health server for orchestrators, such as :8081, disabled when empty
+var healthAddr string
+
+// Time without a successful poll past which a failing agent is not ready anymore
+var readyPollAge = 5 * time.Minute
+
+// Consecutive poll failures after which the agent is not ready anymore, well before ZETTO_MAX_POLL_FAILURES makes it
+// exit so orchestrators stop routing to it first
+var readyPollFailures = 3
+
+// Outcome of the polls, written by the poll loop and read by the health server
+var (
+	// Unix time in nanoseconds of the last successful poll, 0 until the first one
+	lastPollSuccess int64
+
+	// Consecutive poll failures
+	pollFailures int32
+)
+
+// Record the outcome of a poll, a poll finding no job being a success
+func recordPoll(err error) {
+	if err != nil {
+		atomic.AddInt32(&pollFailures, 1)
+		return
+	}
+	atomic.StoreInt32(&pollFailures, 0)
+	atomic.StoreInt64(&lastPollSuccess, time.Now().UnixNano())
+}
+
+// Whether the agent is ready, and why not. A busy agent which stopped polling is still ready, only failing polls and
+// the shutdown make it unready
+func readiness() (bool, string) {
+	if shuttingDown() {
+		return false, "shutting down"
+	}
+
+	last := atomic.LoadInt64(&lastPollSuccess)
+	if last == 0 {
+		return false, "no successful poll yet"
+	}
+
+	failures := int(atomic.LoadInt32(&pollFailures))
+	if failures >= readyPollFailures {
+		return false, fmt.Sprintf("%d consecutive poll failures", failures)
+	}
+	if since := time.Since(time.Unix(0, last)); failures > 0 && since > readyPollAge {
+		return false, fmt.Sprintf("no successful poll for %s", since.Round(time.Second))
+	}
+
+	return true, "ready"
+}
+
+// Serve /healthz, telling the process is alive, and /readyz on healthAddr, in the background so probes never hold up
+// the poll loop
+func serveHealth() error {
+	listener, _, err := listen("health", "tcp", healthAddr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ready, reason := readiness()
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprintln(w, reason)
+	})
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			agentLog.Errorf("Health server stopped : %v\n", err)
+		}
+	}()
+
+	return nil
+}
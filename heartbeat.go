@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Interval between heartbeats of a running job, 0 disables them
+var heartbeatInterval = 30 * time.Second
+
+type jobHeartbeat struct {
+	RunID    string `json:"run_id"`
+	Runner   string `json:"runner"`
+	Progress *int   `json:"progress,omitempty"`
+
+	// Whether the command wrote anything on STDOUT or STDERR yet, and when it last did
+	OutputProduced bool       `json:"output_produced"`
+	LastOutputAt   *time.Time `json:"last_output_at,omitempty"`
+}
+
+// Live state of a running job, shared between the execution and its heartbeats
+type jobState struct {
+	// Progress percentage reported by the command, -1 until it reports one
+	progress int32
+
+	// Unix time in nanoseconds of the last byte written by the command on STDOUT or STDERR, 0 until it writes one
+	lastOutput int64
+
+	mu       sync.Mutex
+	warnings []string
+
+	// Sender of the checkpoints, nil when partial results are disabled
+	partials *partialSender
+
+	// Timeout declared by the command through its handshake, only the first one is honored
+	timeoutRequests  chan time.Duration
+	timeoutRequested bool
+}
+
+func newJobState() *jobState {
+	return &jobState{
+		progress:        -1,
+		timeoutRequests: make(chan time.Duration, 1),
+	}
+}
+
+// Handle the markers of the fd 3 control pipe, which may also carry the "ZETTO_TIMEOUT: 300" handshake
+func (s *jobState) handleControlMarker(name string, value string) bool {
+	if name != "TIMEOUT" {
+		return s.handleMarker(name, value)
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		log.Printf("Ignoring invalid timeout handshake %q\n", value)
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timeoutRequested {
+		log.Println("Ignoring repeated timeout handshake")
+		return true
+	}
+	s.timeoutRequested = true
+	s.timeoutRequests <- time.Duration(seconds) * time.Second
+
+	return true
+}
+
+// Handle the "ZETTO_PROGRESS: 42", "ZETTO_WARNING: message" and "ZETTO_CHECKPOINT: data" markers of the command
+func (s *jobState) handleMarker(name string, value string) bool {
+	switch name {
+	case "CHECKPOINT":
+		if s.partials == nil {
+			return false
+		}
+		s.mu.Lock()
+		s.partials.send(value)
+		s.mu.Unlock()
+		return true
+
+	case "WARNING":
+		s.mu.Lock()
+		s.warnings = append(s.warnings, value)
+		s.mu.Unlock()
+		return true
+
+	case "PROGRESS":
+		percent, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+		if err != nil || percent < 0 || percent > 100 {
+			log.Printf("Ignoring invalid progress %q\n", value)
+			return true
+		}
+		atomic.StoreInt32(&s.progress, int32(percent))
+		return true
+	}
+
+	return false
+}
+
+// Writer recording the time of the last write of the command, which tells a silent command from a producing one
+type outputTracker struct {
+	out   io.Writer
+	state *jobState
+}
+
+func (s *jobState) trackOutput(out io.Writer) io.Writer {
+	return &outputTracker{out: out, state: s}
+}
+
+func (t *outputTracker) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		atomic.StoreInt64(&t.state.lastOutput, time.Now().UnixNano())
+	}
+	return t.out.Write(p)
+}
+
+// Non-fatal warnings reported by the command
+func (s *jobState) reportedWarnings() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.warnings...)
+}
+
+// Response of the API to a heartbeat, which may ask for the job to be cancelled with {"action":"cancel"}
+type heartbeatResponse struct {
+	Action string `json:"action"`
+}
+
+// Periodically tell the API that a job is still running, until the returned function is called.
+// The job is cancelled when the API answers a heartbeat with a cancel action
+func (a *Agent) startHeartbeat(job jobConfig, state *jobState, cancel context.CancelFunc) func() {
+	if heartbeatInterval <= 0 {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				cancelled, err := a.heartbeat(job, state)
+				if err != nil {
+					runLog(job).Errorf("Error sending heartbeat : %v\n", err)
+				}
+				if cancelled {
+					runLog(job).Printf("Run %s cancelled by the API\n", job.ID)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+	}
+}
+
+// Send a single heartbeat for a running job, returning true when the API asks for its cancellation
+func (a *Agent) heartbeat(job jobConfig, state *jobState) (bool, error) {
+	beat := jobHeartbeat{
+		RunID:  job.ID,
+		Runner: a.RunnerName,
+	}
+	if progress := int(atomic.LoadInt32(&state.progress)); progress >= 0 {
+		beat.Progress = &progress
+	}
+	if lastOutput := atomic.LoadInt64(&state.lastOutput); lastOutput > 0 {
+		at := time.Unix(0, lastOutput).UTC()
+		beat.OutputProduced = true
+		beat.LastOutputAt = &at
+	}
+
+	payload, err := json.Marshal(beat)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := a.newRequest("POST", "heartbeat", bytes.NewBuffer(payload))
+	if err != nil {
+		return false, err
+	}
+
+	res, err := a.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return false, fmt.Errorf("Heartbeat error %d", res.StatusCode)
+	}
+
+	// Empty bodies, as sent by APIs predating cancellation, just acknowledge the heartbeat
+	var response heartbeatResponse
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	if len(bytes.TrimSpace(body)) > 0 && json.Unmarshal(body, &response) == nil {
+		return response.Action == "cancel", nil
+	}
+
+	return false, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Maximum number of redirects followed by API calls, 0 to never follow them
+var followRedirects = 3
+
+// Transport shared by all the API calls
+var httpTransport = http.DefaultTransport.(*http.Transport).Clone()
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Parse a minimum TLS version such as 1.2, 0 keeping Go's default
+func parseTLSVersion(value string) (uint16, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	version, ok := tlsVersions[value]
+	if !ok {
+		return 0, fmt.Errorf("expected 1.0, 1.1, 1.2 or 1.3, got %q", value)
+	}
+	return version, nil
+}
+
+// Parse a comma-separated list of cipher suite names. Only the suites of TLS 1.2 and below can be chosen, TLS 1.3
+// ones are not configurable
+func parseCipherSuites(value string) ([]uint16, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	available := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		for _, version := range suite.SupportedVersions {
+			if version < tls.VersionTLS13 {
+				available[suite.Name] = suite.ID
+			}
+		}
+	}
+
+	suites := []uint16{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or unconfigurable cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// Load the client certificate presented to the API for mutual TLS, none when its files are not set
+func loadClientCertificate(certFile string, keyFile string) ([]tls.Certificate, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both ZETTO_CLIENT_CERT and ZETTO_CLIENT_KEY are needed")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the client certificate : %v", err)
+	}
+	return []tls.Certificate{certificate}, nil
+}
+
+// Load the CA certificates the API's certificate is checked against, nil for the system ones
+func loadCACertificates(caFile string) (*x509.CertPool, error) {
+	if caFile == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the CA certificate : %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("no PEM certificate found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// Set the TLS settings of all the API calls, Go's defaults being kept for zero values
+func configureTLS(minVersion uint16, cipherSuites []uint16, certificates []tls.Certificate, rootCAs *x509.CertPool) {
+	httpTransport.TLSClientConfig = &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
+		Certificates: certificates,
+		RootCAs:      rootCAs,
+	}
+}
+
+// Parse the proxy of the API calls, over HTTP, HTTPS or SOCKS5. Nil when empty, the HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY variables being honored then
+func parseProxyURL(value string) (*url.URL, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	proxy, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	switch proxy.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("expected an http, https or socks5 URL, got %q", proxy.Redacted())
+	}
+	if proxy.Host == "" {
+		return nil, fmt.Errorf("missing proxy host in %q", proxy.Redacted())
+	}
+	return proxy, nil
+}
+
+// Password of a proxy URL, kept out of the logs
+func proxyPassword(value string) string {
+	proxy, err := url.Parse(value)
+	if err != nil || proxy.User == nil {
+		return ""
+	}
+	password, _ := proxy.User.Password()
+	return password
+}
+
+// Route all the API calls through a proxy, or through the one of the environment when nil
+func configureProxy(proxy *url.URL) {
+	if proxy == nil {
+		httpTransport.Proxy = http.ProxyFromEnvironment
+		return
+	}
+	httpTransport.Proxy = http.ProxyURL(proxy)
+}
+
+// Timeouts of the API calls, and of the notifies whose payloads can be large. 0 for no timeout
+var (
+	httpTimeout   = 10 * time.Second
+	notifyTimeout = time.Minute
+)
+
+// Whether polls are held open by the API until a job is available, for up to longPollHold
+var (
+	longPoll     bool
+	longPollHold = time.Minute
+)
+
+// Empty long polls answered quicker than this were not held by the API, which may not support them
+const minLongPollHold = time.Second
+
+// Timeout of the polls, over the hold time of long polls
+func pollTimeout() time.Duration {
+	if !longPoll || httpTimeout == 0 {
+		return httpTimeout
+	}
+	return longPollHold + httpTimeout
+}
+
+// Build a client for the API calls
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:       timeout,
+		Transport:     httpTransport,
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// Follow a limited number of redirects, keeping the API credentials on same-origin redirects only
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if followRedirects <= 0 {
+		log.Printf("Not following redirect to %s\n", req.URL.Redacted())
+		return http.ErrUseLastResponse
+	}
+
+	if len(via) > followRedirects {
+		return fmt.Errorf("Stopped after %d redirects", followRedirects)
+	}
+
+	log.Printf("Following redirect to %s\n", req.URL.Redacted())
+
+	original := via[0]
+	if req.URL.Scheme == original.URL.Scheme && req.URL.Host == original.URL.Host {
+		req.Header.Set("Authorization", original.Header.Get("Authorization"))
+	} else {
+		req.Header.Del("Authorization")
+	}
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Source of the run nonces
+var nonceReader io.Reader = rand.Reader
+
+// Nonces drawn so far, telling apart the fallback nonces drawn at the same time
+var noncesDrawn uint64
+
+// Random nonce of a run's result, drawn once when the run is done. Should the random source fail, the nonce is made
+// of the time and a counter, which still differ between runs
+func newRunNonce() string {
+	count := atomic.AddUint64(&noncesDrawn, 1)
+
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(nonceReader, nonce); err != nil {
+		agentLog.Errorf("Error drawing a run nonce : %v, using the time instead\n", err)
+		return fmt.Sprintf("%x-%x", time.Now().UnixNano(), count)
+	}
+	return hex.EncodeToString(nonce)
+}
+
+// Idempotency-Key of the notifies of a result, for the API to record it once : the same for every delivery of the
+// result, retries and replays from the spool included, and different between runs
+func idempotencyKey(job jobConfig, result runResult) string {
+	return fmt.Sprintf("%s-%s", job.ID, result.Nonce)
+}
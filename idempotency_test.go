@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestRunNonce(t *testing.T) {
+	defer func(saved io.Reader) { nonceReader = saved }(nonceReader)
+
+	nonceReader = bytes.NewReader(bytes.Repeat([]byte{0xab}, 32))
+	if nonce := newRunNonce(); nonce != "abababababababababababababababab" {
+		t.Errorf("got nonce %s", nonce)
+	}
+
+	// The random source failing still gives distinct nonces
+	nonceReader = iotest.ErrReader(errors.New("entropy exhausted"))
+	first, second := newRunNonce(), newRunNonce()
+	if first == "" || first == second {
+		t.Errorf("got fallback nonces %q and %q", first, second)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	defer func(reader io.Reader, delay time.Duration) {
+		nonceReader, notifyRetryDelay = reader, delay
+	}(nonceReader, notifyRetryDelay)
+	notifyRetryDelay = 10 * time.Millisecond
+
+	// Two runs, drawing their nonces in turn
+	nonceReader = bytes.NewReader(append(bytes.Repeat([]byte{0x01}, 16), bytes.Repeat([]byte{0x02}, 16)...))
+	useRunner(t, `echo '"ok"'`+"\n")
+	api := newFakeAPI(t)
+	api.addJobs(`{"id": "key-1", "command": "echo"}`, `{"id": "key-2", "command": "echo"}`)
+	agent := api.agent()
+
+	// The first delivery of the first run times out on the API side, it is retried
+	api.failNext("/notify", http.StatusGatewayTimeout)
+	api.pollAndRun(t, agent)
+	api.pollAndRun(t, agent)
+
+	keys := []string{}
+	for _, request := range api.requestsTo("/notify") {
+		keys = append(keys, request.Header.Get("Idempotency-Key"))
+	}
+	want := []string{
+		"key-1-01010101010101010101010101010101",
+		"key-1-01010101010101010101010101010101",
+		"key-2-02020202020202020202020202020202",
+	}
+	if len(keys) != len(want) {
+		t.Fatalf("got keys %v, want %v", keys, want)
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Errorf("got key %s for notify %d, want %s", keys[i], i, want[i])
+		}
+	}
+}
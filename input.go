@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Input delivery modes : as the last argument of the command, as the path of a file holding it, or on its STDIN
+const (
+	inputModeArg   = "arg"
+	inputModeFile  = "file"
+	inputModeStdin = "stdin"
+)
+
+// How the input is handed to commands, through ZETTO_INPUT_MODE
+var inputMode = inputModeArg
+
+// Largest input accepted, 0 for the default of the input mode
+var maxInputBytes int
+
+// Default input limits : a single argument is capped by the kernel (128KiB on Linux), a file or STDIN is not
+const (
+	defaultMaxArgInputBytes  = 128 * 1024
+	defaultMaxFileInputBytes = 64 * 1024 * 1024
+)
+
+// Check the input fits the limit of the input mode, rather than failing cryptically when starting the command
+func checkInputSize(input string) error {
+	limit := maxInputBytes
+	if limit <= 0 {
+		limit = defaultMaxArgInputBytes
+		if inputMode != inputModeArg {
+			limit = defaultMaxFileInputBytes
+		}
+	}
+
+	if len(input) <= limit {
+		return nil
+	}
+	if inputMode == inputModeArg {
+		return fmt.Errorf("Input of %d bytes is over the limit of %d bytes, ZETTO_INPUT_MODE=file or stdin handles larger inputs", len(input), limit)
+	}
+	return fmt.Errorf("Input of %d bytes is over the limit of %d bytes", len(input), limit)
+}
+
+// Write the input of a run to a private temp file, returning its path and a function removing it
+func writeInputFile(input string) (string, func(), error) {
+	file, err := os.CreateTemp("", "zetto-input-*")
+	if err != nil {
+		return "", nil, err
+	}
+	remove := func() {
+		os.Remove(file.Name())
+	}
+
+	// CreateTemp already restricts the file to the agent's user, which matters as inputs may hold secrets
+	if _, err := file.WriteString(input); err != nil {
+		file.Close()
+		remove()
+		return "", nil, err
+	}
+	if err := file.Close(); err != nil {
+		remove()
+		return "", nil, err
+	}
+
+	return file.Name(), remove, nil
+}
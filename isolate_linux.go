@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Whether each job runs in fresh mount, PID and network namespaces
+var isolateJobs bool
+
+// Process attributes of a job command
+func jobSysProcAttr() *syscall.SysProcAttr {
+	if !isolateJobs {
+		return nil
+	}
+
+	attr := &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET,
+	}
+
+	// Without root, the namespaces can only be created within an unprivileged user namespace
+	if uid := os.Geteuid(); uid != 0 {
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getegid(), Size: 1}}
+	}
+
+	return attr
+}
+
+func isolationSupported() bool {
+	return true
+}
+
+// Whether a command failed to start for its namespaces, which clone refuses with EPERM when they are not permitted,
+// and with EINVAL when the kernel does not support them
+func isIsolationError(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EINVAL)
+}
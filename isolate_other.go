@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// Namespaces only exist on Linux
+var isolateJobs bool
+
+func jobSysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+func isolationSupported() bool {
+	return false
+}
+
+func isIsolationError(err error) bool {
+	return false
+}
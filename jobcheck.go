@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Problems making a job of a linted job file unfit to run. Commands are only checked when the known ones are given
+func validateJob(job jobConfig, known map[string]bool) []string {
+	problems := []string{}
+	if job.ID == "" {
+		problems = append(problems, "missing id")
+	}
+	if job.Command == "" {
+		problems = append(problems, "missing command")
+	} else if known != nil && !known[job.Command] {
+		problems = append(problems, fmt.Sprintf("unknown command %q", job.Command))
+	}
+	if job.Input != "" && !json.Valid([]byte(job.Input)) {
+		problems = append(problems, "input is not valid JSON")
+	}
+
+	return problems
+}
+
+// Entry of a command list : either the name of a command, or an object such as {"name": "build", "timeout": 600}
+// giving the default timeout, in seconds, of its jobs
+type listedCommand struct {
+	Name    string `json:"name"`
+	Timeout int    `json:"timeout"`
+}
+
+func (c *listedCommand) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &c.Name); err == nil {
+		return nil
+	}
+
+	type object listedCommand
+	if err := json.Unmarshal(data, (*object)(c)); err != nil {
+		return err
+	}
+	if c.Name == "" {
+		return fmt.Errorf("command without a name")
+	}
+	return nil
+}
+
+// Parse a command list, a JSON array of command names or objects
+func parseCommandsList(commands string) ([]listedCommand, error) {
+	list := []listedCommand{}
+	if err := json.Unmarshal([]byte(commands), &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Set of the commands of a command list, nil if the list can not be parsed
+func knownCommands(commands string) map[string]bool {
+	list, err := parseCommandsList(commands)
+	if err != nil {
+		return nil
+	}
+
+	known := map[string]bool{}
+	for _, command := range list {
+		known[command.Name] = true
+	}
+	return known
+}
+
+// Fail a list run whose output is not a complete JSON array of commands
+func checkCommandsList(result *runResult) {
+	if !result.Success || knownCommands(result.Output) != nil {
+		return
+	}
+
+	agentLog.Warnf("Invalid commands list %q\n", truncate(result.Output, 200))
+	result.Success = false
+}
+
+func truncate(text string, length int) string {
+	if len(text) <= length {
+		return text
+	}
+	return text[:length] + "..."
+}
+
+// Lint a JSON file holding an array of jobs, without running anything. The commands file, optional, holds
+// the output of "$ZETTO_RUNNER list". Prints a report, and returns the exit code of the agent
+func validateJobFile(path string, commandsPath string) int {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	jobs := []jobConfig{}
+	if err := json.Unmarshal(content, &jobs); err != nil {
+		fmt.Fprintf(os.Stderr, "%s : expected a JSON array of jobs (%v)\n", path, err)
+		return 1
+	}
+
+	var known map[string]bool
+	if commandsPath != "" {
+		commands, err := os.ReadFile(commandsPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if known = knownCommands(string(commands)); known == nil {
+			fmt.Fprintf(os.Stderr, "%s : expected a JSON array of commands\n", commandsPath)
+			return 2
+		}
+	}
+
+	invalid := 0
+	for i, job := range jobs {
+		problems := validateJob(job, known)
+		if len(problems) == 0 {
+			continue
+		}
+		invalid++
+		for _, problem := range problems {
+			fmt.Printf("job %d (%s) : %s\n", i, job.ID, problem)
+		}
+	}
+
+	fmt.Printf("%d jobs, %d invalid\n", len(jobs), invalid)
+	if invalid > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Commands the agent may run, any when empty. The API picks the commands, the allowlist bounds what a compromised or
+// misconfigured API can make the runners do
+var allowedCommands = map[string]bool{}
+
+// Whether a command may run. The commands list, which the agent calls on its own, always may
+func commandAllowed(command string) bool {
+	return len(allowedCommands) == 0 || allowedCommands[command] || command == "list"
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAllowedCommands(t *testing.T) {
+	defer func(saved map[string]bool) { allowedCommands = saved }(allowedCommands)
+	useRunner(t, `echo '"ran"'`+"\n")
+
+	tests := []struct {
+		name    string
+		allowed map[string]bool
+		command string
+		ran     bool
+	}{
+		{"allowed", map[string]bool{"build": true, "deploy": true}, "build", true},
+		{"disallowed", map[string]bool{"build": true, "deploy": true}, "wipe", false},
+		{"empty allowlist", map[string]bool{}, "wipe", true},
+		{"list", map[string]bool{"build": true}, "list", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			allowedCommands = test.allowed
+			api := newFakeAPI(t)
+			api.addJobs(fmt.Sprintf(`{"id": "allow-%s", "command": %q}`, test.command, test.command))
+
+			api.pollAndRun(t, api.agent())
+
+			notifies := api.notifies(t)
+			if len(notifies) != 1 {
+				t.Fatalf("got %d notifies, want 1", len(notifies))
+			}
+			notify := notifies[0]
+			if test.ran {
+				if !notify.Success || notify.Output != "\"ran\"\n" {
+					t.Errorf("got success %v, output %q, want the command to run", notify.Success, notify.Output)
+				}
+				return
+			}
+			if notify.Success || notify.Reason != "command_not_allowed" || notify.Output != "null" {
+				t.Errorf("got success %v, reason %q, output %q, want a rejected run", notify.Success, notify.Reason, notify.Output)
+			}
+		})
+	}
+}
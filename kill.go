@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Time given to a command to exit after SIGTERM, before it is killed
+var killGrace = 5 * time.Second
+
+// Above this many ignored SIGTERMs, a command is flagged as misbehaving
+const sigtermIgnoredWarning = 3
+
+var (
+	sigtermIgnoredMu sync.Mutex
+	sigtermIgnored   = map[string]int{}
+)
+
+var (
+	runningGroupsMu sync.Mutex
+
+	// Process groups of the running commands, killed on the way out after a second signal
+	runningGroups = map[int]bool{}
+)
+
+// Track the process group of a started command, until the returned function is called once it was waited for
+func trackProcessGroup(pid int) func() {
+	runningGroupsMu.Lock()
+	defer runningGroupsMu.Unlock()
+	runningGroups[pid] = true
+
+	return func() {
+		runningGroupsMu.Lock()
+		defer runningGroupsMu.Unlock()
+		delete(runningGroups, pid)
+	}
+}
+
+// Kill the process groups of all the running commands
+func killRunningGroups() {
+	runningGroupsMu.Lock()
+	defer runningGroupsMu.Unlock()
+
+	for pid := range runningGroups {
+		if err := killProcessGroup(pid); err != nil {
+			agentLog.Errorf("Error killing process group %d : %v\n", pid, err)
+		}
+	}
+}
+
+// Cancel function of a command started with exec.CommandContext : once its context is done, the command and its
+// descendants are asked to terminate with SIGTERM, or killed without a grace period. signaled is set once they were.
+// Past the command's WaitDelay exec kills the command itself, so the grace period is checked to stay under it
+func terminateOnCancel(cmd *exec.Cmd, signaled *int32) func() error {
+	return func() error {
+		atomic.StoreInt32(signaled, 1)
+		if killGrace > 0 && terminateProcessGroup(cmd.Process.Pid) == nil {
+			return nil
+		}
+
+		// Already exiting, or no SIGTERM on this platform
+		return killProcessGroup(cmd.Process.Pid)
+	}
+}
+
+// Wait for a command asked to terminate to exit within the grace period. Returns its exit code, and false when it is
+// still running and has to be killed
+func awaitTermination(job jobConfig, done chan int) (int, bool) {
+	if killGrace <= 0 {
+		return 0, false
+	}
+
+	timer := time.NewTimer(killGrace)
+	defer timer.Stop()
+
+	select {
+	case exitCode := <-done:
+		return exitCode, true
+	case <-timer.C:
+		countIgnoredSigterm(job)
+		return 0, false
+	}
+}
+
+// Track the commands which do not exit on SIGTERM, as they otherwise just look slow
+func countIgnoredSigterm(job jobConfig) {
+	sigtermIgnoredTotal.inc(job.Command)
+
+	sigtermIgnoredMu.Lock()
+	sigtermIgnored[job.Command]++
+	count := sigtermIgnored[job.Command]
+	sigtermIgnoredMu.Unlock()
+
+	runLog(job).Warnf("Command %s ignored SIGTERM for run %s, killing it\n", job.Command, job.ID)
+	if count >= sigtermIgnoredWarning {
+		runLog(job).Warnf("Command %s repeatedly ignores SIGTERM (%d times), its runner should handle it\n", job.Command, count)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Static labels of the agent, such as its region or pool, sent with the polls and the results
+var labels map[string]string
+
+// Parse labels such as region=eu-west,pool=gpu
+func parseLabels(spec string) (map[string]string, error) {
+	parsed := map[string]string{}
+	if strings.TrimSpace(spec) == "" {
+		return parsed, nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" {
+			return nil, fmt.Errorf("Invalid label %q, expected key=value", entry)
+		}
+		if _, ok := parsed[key]; ok {
+			return nil, fmt.Errorf("Duplicate label %q", key)
+		}
+		parsed[key] = strings.TrimSpace(parts[1])
+	}
+
+	return parsed, nil
+}
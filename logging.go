@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Format of the agent's own logs : text by default, or json for one object per line
+var logFormat = "text"
+
+// Whether debug lines are logged
+var debugLogs bool
+
+const (
+	levelDebug = "debug"
+	levelInfo  = "info"
+	levelWarn  = "warn"
+	levelError = "error"
+)
+
+type logLine struct {
+	Time     string `json:"time"`
+	Level    string `json:"level"`
+	Msg      string `json:"msg"`
+	RunID    string `json:"run_id,omitempty"`
+	Hostname string `json:"hostname"`
+}
+
+// Output of the standard logger, which redacts secrets, see redactLog, and formats lines as JSON when enabled
+type logWriter struct {
+	mu       sync.Mutex
+	out      io.Writer
+	json     bool
+	hostname string
+	secrets  []string
+
+	// Loggers of the text lines of each level, formatted as the standard logger's
+	text map[string]*log.Logger
+}
+
+// Writer of the agent's logs, nil until the configuration is loaded
+var logs *logWriter
+
+// Route the standard logger through the log writer. The secrets never appear in a log line
+func initLogging(format string, secrets ...string) {
+	hostname, _ := os.Hostname()
+	logs = &logWriter{
+		out:      log.Writer(),
+		json:     format == "json",
+		hostname: hostname,
+	}
+	for _, secret := range secrets {
+		if secret != "" {
+			logs.secrets = append(logs.secrets, secret)
+		}
+	}
+
+	logs.text = map[string]*log.Logger{}
+	for _, level := range []string{levelDebug, levelInfo, levelWarn, levelError} {
+		logs.text[level] = log.New(levelWriter{logs, level}, "", log.Flags())
+	}
+
+	log.SetOutput(logs)
+	if logs.json {
+		log.SetFlags(0)
+	}
+}
+
+// Lines of the standard logger, which carry no level nor run
+func (w *logWriter) Write(p []byte) (int, error) {
+	return w.write(levelInfo, p)
+}
+
+func (w *logWriter) write(level string, p []byte) (int, error) {
+	if w.json {
+		w.writeLine(level, "", string(p))
+		return len(p), nil
+	}
+
+	line := redactLog(string(p))
+	w.mu.Lock()
+	_, err := io.WriteString(w.out, line)
+	w.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	if sendToSyslog != nil {
+		sendToSyslog(level, line)
+	}
+	return len(p), nil
+}
+
+// Output of the text loggers of a level
+type levelWriter struct {
+	logs  *logWriter
+	level string
+}
+
+func (w levelWriter) Write(p []byte) (int, error) {
+	return w.logs.write(w.level, p)
+}
+
+func (w *logWriter) writeLine(level string, runID string, msg string) {
+	line, err := json.Marshal(logLine{
+		Time:     time.Now().UTC().Format(time.RFC3339Nano),
+		Level:    level,
+		Msg:      redactLog(strings.TrimRight(msg, "\n")),
+		RunID:    runID,
+		Hostname: w.hostname,
+	})
+	if err != nil {
+		return
+	}
+
+	w.mu.Lock()
+	w.out.Write(append(line, '\n'))
+	w.mu.Unlock()
+
+	if sendToSyslog != nil {
+		sendToSyslog(level, string(line))
+	}
+}
+
+func (w *logWriter) redact(msg string) string {
+	for _, secret := range w.secrets {
+		msg = strings.ReplaceAll(msg, secret, "[REDACTED]")
+	}
+	return msg
+}
+
+// Leveled logger, whose lines carry the ID of the run they are about in JSON logs
+type logger struct {
+	runID string
+}
+
+// Logger of the agent itself, not tied to a run
+var agentLog = logger{}
+
+// Logger of a run, so that every line logged during it can be correlated
+func runLog(job jobConfig) logger {
+	return logger{runID: job.ID}
+}
+
+func (l logger) Debugf(format string, v ...interface{}) {
+	if debugLogs {
+		l.output(levelDebug, fmt.Sprintf(format, v...))
+	}
+}
+
+func (l logger) Println(v ...interface{}) {
+	l.output(levelInfo, fmt.Sprintln(v...))
+}
+
+func (l logger) Printf(format string, v ...interface{}) {
+	l.output(levelInfo, fmt.Sprintf(format, v...))
+}
+
+func (l logger) Warnf(format string, v ...interface{}) {
+	l.output(levelWarn, fmt.Sprintf(format, v...))
+}
+
+func (l logger) Errorf(format string, v ...interface{}) {
+	l.output(levelError, fmt.Sprintf(format, v...))
+}
+
+func (l logger) output(level string, msg string) {
+	if logs == nil {
+		log.Output(3, msg)
+		return
+	}
+	if !logs.json {
+		// Text logs stay as they always were, their level only goes to syslog
+		logs.text[level].Output(3, msg)
+		return
+	}
+
+	logs.writeLine(level, l.runID, msg)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Whether the STDOUT and STDERR of running jobs are streamed to the API as they are produced, on top of the final notify
+var streamLogs bool
+
+// Longest delay before the output of a command is streamed
+var logStreamInterval = time.Second
+
+// Output waiting to be streamed past which it is sent without waiting for the interval
+const logStreamBatchBytes = 64 * 1024
+
+// Output kept while the log endpoint is unreachable, past which the oldest chunks are dropped
+const logStreamBufferBytes = 1024 * 1024
+
+type logChunk struct {
+	Sequence int    `json:"sequence"`
+	Stream   string `json:"stream"`
+	Data     string `json:"data"`
+}
+
+// Chunks streamed in one call
+type logBatch struct {
+	RunID  string     `json:"run_id"`
+	Chunks []logChunk `json:"chunks"`
+}
+
+// Batches the output of a running job into chunks, delivered in order without blocking its execution.
+// Consecutive writes to the same stream share a chunk, so the interleaving of STDOUT and STDERR is kept
+type logStreamer struct {
+	job jobConfig
+
+	mu       sync.Mutex
+	pending  []logChunk
+	size     int
+	sequence int
+
+	full    chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+}
+
+func (a *Agent) startLogStreamer(job jobConfig) *logStreamer {
+	streamer := &logStreamer{
+		job:     job,
+		full:    make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(streamer.done)
+
+		ticker := time.NewTicker(logStreamInterval)
+		defer ticker.Stop()
+
+		var unsent []logChunk
+		retries := newBackoff(partialRetryDelay, maxPartialRetryDelay)
+		var retry <-chan time.Time
+		for {
+			closing := false
+			select {
+			case <-streamer.closing:
+				closing = true
+			case <-ticker.C:
+			case <-streamer.full:
+			case <-retry:
+				retry = nil
+			}
+
+			unsent = streamer.keep(append(unsent, streamer.take()...))
+			if closing {
+				// Last attempt, the final result is about to be notified
+				if len(unsent) == 0 {
+					return
+				}
+				if unsent = a.deliverLogChunks(job, unsent); unsent != nil {
+					runLog(job).Warnf("Dropping %d undelivered log chunks\n", len(unsent))
+				}
+				return
+			}
+			if retry != nil || len(unsent) == 0 {
+				// Still waiting for the endpoint to come back, or nothing to send
+				continue
+			}
+
+			if unsent = a.deliverLogChunks(job, unsent); unsent == nil {
+				retries.succeeded()
+				continue
+			}
+			if streamDisconnect == "drop" {
+				runLog(job).Warnf("Dropping %d undelivered log chunks\n", len(unsent))
+				unsent = nil
+				continue
+			}
+			retry = time.After(retries.failed())
+		}
+	}()
+
+	return streamer
+}
+
+// Writer of one of the streams of the command, "stdout" or "stderr"
+func (s *logStreamer) writer(stream string) *logStreamWriter {
+	return &logStreamWriter{streamer: s, stream: stream}
+}
+
+func (s *logStreamer) write(stream string, p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if last := len(s.pending) - 1; last >= 0 && s.pending[last].Stream == stream {
+		s.pending[last].Data += string(p)
+	} else {
+		s.sequence++
+		s.pending = append(s.pending, logChunk{Sequence: s.sequence, Stream: stream, Data: string(p)})
+	}
+
+	s.size += len(p)
+	if s.size >= logStreamBatchBytes {
+		select {
+		case s.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Chunks written since the last call
+func (s *logStreamer) take() []logChunk {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chunks := s.pending
+	s.pending = nil
+	s.size = 0
+	return chunks
+}
+
+// Drop the oldest chunks past the buffer size
+func (s *logStreamer) keep(chunks []logChunk) []logChunk {
+	size := 0
+	for _, chunk := range chunks {
+		size += len(chunk.Data)
+	}
+
+	dropped := 0
+	for size > logStreamBufferBytes && len(chunks) > 1 {
+		size -= len(chunks[0].Data)
+		chunks = chunks[1:]
+		dropped++
+	}
+	if dropped > 0 {
+		runLog(s.job).Warnf("Too much undelivered output, dropping %d log chunks\n", dropped)
+	}
+
+	return chunks
+}
+
+// Deliver the output written so far, and stop streaming
+func (s *logStreamer) close() {
+	close(s.closing)
+	<-s.done
+}
+
+type logStreamWriter struct {
+	streamer *logStreamer
+	stream   string
+}
+
+// Only buffers, so the command never waits for the API
+func (w *logStreamWriter) Write(p []byte) (int, error) {
+	w.streamer.write(w.stream, p)
+	return len(p), nil
+}
+
+// Deliver chunks in a single call. Returns them if they are left to deliver
+func (a *Agent) deliverLogChunks(job jobConfig, chunks []logChunk) []logChunk {
+	if err := a.sendLogBatch(logBatch{RunID: job.ID, Chunks: chunks}); err != nil {
+		runLog(job).Errorf("Error streaming logs : %v\n", err)
+		return chunks
+	}
+	return nil
+}
+
+// Deliver chunks of the output of a running job
+func (a *Agent) sendLogBatch(batch logBatch) error {
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	req, err := a.newRequest("POST", fmt.Sprintf("runs/%s/logs", url.PathEscape(batch.RunID)), bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+
+	res, err := a.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Log stream error %d", res.StatusCode)
+	}
+
+	return nil
+}
@@ -2,14 +2,23 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash"
+	"io"
 	"log"
+	"math"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/exec"
-	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,119 +27,492 @@ type jobConfig struct {
 	Command string `json:"command"`
 	Input   string `json:"input"`
 	Timeout int    `json:"timeout"`
+
+	// Optional kind of workload, such as python or node, run by the runner of the type in ZETTO_RUNNERS
+	Type string `json:"type,omitempty"`
+
+	// Environment variables of the job, added to the agent's. They may hold secrets and are never logged
+	Env map[string]string `json:"env,omitempty"`
+
+	// Optional directory the command starts in, instead of ZETTO_WORKDIR
+	Workdir string `json:"workdir,omitempty"`
+
+	// When the job was claimed from the API, to measure how long it waited before running
+	claimedAt time.Time
 }
 
 type runResult struct {
 	Success bool
 	Output  string
 	Logs    string
+
+	// Set when the run was interrupted through its context, Graceful telling if the process exited by itself
+	Cancelled bool
+	Graceful  bool
+
+	// Hex SHA-256 of the full STDOUT, only computed when ZETTO_HASH_OUTPUT is enabled
+	OutputSHA256 string
+
+	// Number of times starting the command was retried for lack of resources
+	StartRetries int
+
+	// Drawn once per result, identifies it in the Idempotency-Key of its notifies
+	Nonce string
+
+	// Time between the job's claim and the start of its execution
+	QueueWait time.Duration
+
+	// Machine-readable cause of a failure happening outside of the command itself
+	Reason string
+
+	// Timeout of each attempt, in seconds, when failed executions are retried
+	AttemptTimeouts []int
+
+	// Non-fatal warnings reported through "ZETTO_WARNING: message" markers, whatever the outcome
+	Warnings []string
+
+	// Name of the signal which terminated the command, such as SIGKILL, empty when it exited by itself
+	Signal string
+
+	// Fields extracted from the logs and output through the ZETTO_EXTRACT_<NAME> patterns
+	Metadata map[string]string
+
+	// Set when the output or logs reached their limit, and the command was killed. TruncatedStreams tells which of
+	// stdout and stderr did
+	Truncated        bool
+	TruncatedStreams []string
+
+	// Set when the command exited but a descendant held its output open, and was killed
+	PipesHeldOpen bool
+
+	// Time the command ran for, whether it was killed by its timeout, and its exit code, nil when it did not run
+	Duration time.Duration
+	TimedOut bool
+	ExitCode *int
+
+	// Set when the command could not start for lack of processes or memory, which a later attempt may find
+	StartResourcesLacked bool
+
+	// Revision of the runner commands when the command started, which a refresh may change before the notify
+	Revision string
+}
+
+type jobNack struct {
+	RunID  string `json:"run_id"`
+	Reason string `json:"reason"`
+}
+
+type jobCancelAck struct {
+	RunID    string `json:"run_id"`
+	State    string `json:"state"`
+	Graceful bool   `json:"graceful"`
 }
 
 type jobNotify struct {
-	RunID   string `json:"run_id"`
-	Success bool   `json:"success"`
-	Output  string `json:"output"`
-	Logs    string `json:"logs"`
+	RunID            string   `json:"run_id"`
+	Success          bool     `json:"success"`
+	Output           string   `json:"output"`
+	Logs             string   `json:"logs"`
+	OutputSHA256     string   `json:"output_sha256,omitempty"`
+	StartRetries     int      `json:"start_retries,omitempty"`
+	Warnings         []string `json:"warnings,omitempty"`
+	QueueWaitMs      int64    `json:"queue_wait_ms"`
+	Reason           string   `json:"reason,omitempty"`
+	Cancelled        bool     `json:"cancelled,omitempty"`
+	Signal           string   `json:"killed_by_signal,omitempty"`
+	Revision         string   `json:"command_revision,omitempty"`
+	Truncated        bool     `json:"truncated,omitempty"`
+	TruncatedStreams []string `json:"truncated_streams,omitempty"`
+	DurationMs       int64    `json:"duration_ms"`
+	TimedOut         bool     `json:"timed_out"`
+	ExitCode         *int     `json:"exit_code,omitempty"`
+
+	PipesHeldOpen bool `json:"pipes_held_open,omitempty"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+
+	// Only sent when the run was retried
+	AttemptTimeouts []int `json:"attempt_timeouts,omitempty"`
 }
 
-func getCommandsList() string {
+// Timeout of the list command, which may differ from the jobs' as runners can be slow to start, and its retries
+var (
+	listTimeout = time.Duration(defaultJobTimeout) * time.Second
+	listRetries int
+)
+
+func (a *Agent) getCommandsList() (string, error) {
 	listJob := jobConfig{
 		ID:      "list",
 		Command: "list",
 		Input:   "{}",
+		Timeout: int(math.Ceil(listTimeout.Seconds())),
 	}
 
-	res := execJob(listJob)
+	// A truncated or garbled list would break every poll, it is retried like a failed one
+	res := a.execJob(context.Background(), listJob)
+	checkCommandsList(&res)
+	for attempt := 1; !res.Success && attempt <= listRetries; attempt++ {
+		log.Printf("Could not fetch commands list, retrying (attempt %d)\n", attempt+1)
+		res = a.execJob(context.Background(), listJob)
+		checkCommandsList(&res)
+	}
 
 	if res.Success == false {
-		log.Fatal("Could not fetch commands list")
+		return "", errors.New("Could not fetch commands list")
 	}
+	refreshCapabilities(res.Output)
+	refreshCommandTimeouts(res.Output)
+	refreshRevision()
 
-	return res.Output
+	return res.Output, nil
 }
 
+// Slots shared by all pollers, bounding the number of poll requests in flight. Nil when unbounded
+var pollGate chan struct{}
+
 // Poll the API for a job to run
-func poll(commands string) (*jobConfig, error) {
-	hostname, err := os.Hostname()
-	if err != nil {
-		log.Fatal(err)
+func (a *Agent) poll(commands string) (*jobConfig, error) {
+	// Wait for a poll slot, however many pollers are running
+	if pollGate != nil {
+		pollGate <- struct{}{}
+		defer func() { <-pollGate }()
 	}
-	log.Println("Polling from", hostname)
 
-	client := &http.Client{
-		Timeout: time.Second * 10,
-	}
+	log.Println("Polling from", a.RunnerName)
 
-	payload := fmt.Sprintf("{\"commands\": %s}", commands)
+	// Once the API knows the command list, only its hash is sent
+	hash := commandsHash(commands)
+	hashOnly := commandsHashAcknowledged(hash)
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s", os.Getenv("ZETTO_HOST"), "pop"), bytes.NewBufferString(payload))
+	res, err := a.sendPoll(pollPayload(commands, hash, hashOnly))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("ApiKey %s", os.Getenv("ZETTO_API_KEY")))
-	req.Header.Add("X-Runner-Name", hostname)
-	req.Header.Add("Content-Type", "application/json")
 
-	res, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	// The API does not recognize the hash (anymore), send the full list again
+	if hashOnly && res.StatusCode == http.StatusConflict {
+		res.Body.Close()
+		acknowledgeCommandsHash("")
+		res, err = a.sendPoll(pollPayload(commands, hash, false))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if commandsHashing {
+		acknowledgeCommandsHash(res.Header.Get("X-Commands-Hash"))
 	}
 
-	if res.StatusCode == 404 {
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusNoContent {
 		// No error, just not found
 		return nil, nil
 	}
 
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		return nil, fmt.Errorf("Polling error %d", res.StatusCode)
+		return nil, statusError{"Polling", res.StatusCode}
 	}
 
-	defer res.Body.Close()
-
 	decoder := json.NewDecoder(res.Body)
 	job := jobConfig{}
 	err = decoder.Decode(&job)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("Malformed job : %w", err)
 	}
+	job.claimedAt = time.Now()
 
 	return &job, nil
 }
 
-// Execute a job and returns the runs result
-func execJob(job jobConfig) runResult {
-	// Prepare command : $RUNNER <command> <input>"
-	runner := strings.Split(os.Getenv("ZETTO_RUNNER"), " ")
+// Send a poll request to the API
+func (a *Agent) sendPoll(payload string) (*http.Response, error) {
+	req, err := a.newRequest("POST", "pop", bytes.NewBufferString(payload))
+	if err != nil {
+		return nil, err
+	}
+	if longPoll {
+		// How long the API may hold the request, in seconds
+		req.Header.Add("X-Long-Poll", fmt.Sprintf("%d", int(longPollHold.Seconds())))
+	}
+
+	return a.PollClient.Do(req)
+}
+
+// Upper bound of the timeout a command can declare through its handshake
+var maxTimeout = time.Hour
+
+// Execute a job and returns the runs result. Cancelling the context kills the process
+func (a *Agent) execJob(ctx context.Context, job jobConfig) runResult {
+	jlog := runLog(job)
+
+	// Never run a command off the allowlist, whatever the API sends
+	if !commandAllowed(job.Command) {
+		jlog.Warnf("Rejecting run %s : command %q is not allowed\n", job.ID, job.Command)
+		return runResult{
+			Success: false,
+			Output:  "null",
+			Logs:    fmt.Sprintf("Command %q is not in ZETTO_ALLOWED_COMMANDS", job.Command),
+			Reason:  "command_not_allowed",
+		}
+	}
+
+	// Expand the secrets referenced by the input, failing the run if one can not be resolved
+	input, err := resolveSecrets(job.Input)
+	if err != nil {
+		jlog.Errorf("%v\n", err)
+		return runResult{
+			Success: false,
+			Output:  "null",
+			Logs:    err.Error(),
+			Reason:  "secret_resolution_failed",
+		}
+	}
+
+	if err := checkInputSize(input); err != nil {
+		jlog.Warnf("Rejecting run %s : %v\n", job.ID, err)
+		return runResult{
+			Success: false,
+			Output:  "null",
+			Logs:    err.Error(),
+			Reason:  "input_too_large",
+		}
+	}
+
+	// In file mode the command receives the path of a temp file holding its input, removed whatever the outcome
+	if inputMode == inputModeFile {
+		path, remove, err := writeInputFile(input)
+		if err != nil {
+			jlog.Errorf("Error writing the input file : %v\n", err)
+			return runResult{
+				Success: false,
+				Output:  "null",
+				Logs:    fmt.Sprintf("Could not write the input file : %v", err),
+				Reason:  "input_file_failed",
+			}
+		}
+		defer remove()
+		input = path
+	}
+
+	// An invalid directory only fails this job, it is the API's to fix
+	dir, removeDir, err := jobWorkdir(job)
+	if err != nil {
+		jlog.Warnf("Rejecting run %s : %v\n", job.ID, err)
+		return runResult{
+			Success: false,
+			Output:  "null",
+			Logs:    err.Error(),
+			Reason:  "invalid_workdir",
+		}
+	}
+	defer removeDir()
+
+	// Prepare command : $RUNNER <command> <input>, or $RUNNER <command> with the input on STDIN
+	runner, release, err := resolveRunner(job)
+	if err != nil {
+		jlog.Warnf("Rejecting run %s : %v\n", job.ID, err)
+		return runResult{
+			Success: false,
+			Output:  "null",
+			Logs:    err.Error(),
+			Reason:  "unknown_runner_type",
+		}
+	}
+	defer release()
 	runner = append(runner, job.Command)
-	runner = append(runner, job.Input)
-	cmd := exec.Command(runner[0], runner[1:]...)
+	if inputMode != inputModeStdin {
+		runner = append(runner, input)
+	}
 
 	// Collect stdout and stderr into local buffers for after the execution
 	outBuf := new(bytes.Buffer)
 	logBuf := new(bytes.Buffer)
-	cmd.Stdout = outBuf
-	cmd.Stderr = logBuf
+	var outSink io.Writer = outBuf
+	var logSink io.Writer = logBuf
+
+	// Optionally also stream them to the API while the command runs, the commands list not being a run of the API
+	var logStream *logStreamer
+	if streamLogs && job.Command != "list" {
+		logStream = a.startLogStreamer(job)
+		outSink = io.MultiWriter(outBuf, logStream.writer("stdout"))
+		logSink = io.MultiWriter(logBuf, logStream.writer("stderr"))
+	}
+
+	// Both are capped independently, a runaway command is killed once either reaches its limit
+	outputLimit := newCaptureLimit()
+	cappedOut := newCappedWriter(outSink, maxStdoutBytes, outputLimit)
+	cappedLogs := newCappedWriter(logSink, maxStderrBytes, outputLimit)
+	var stdout io.Writer = cappedOut
+
+	// Markers such as "ZETTO_PROGRESS: 42" may be written on STDERR or on fd 3, and are kept out of the logs.
+	// The "ZETTO_TIMEOUT: 300" handshake is only accepted on fd 3
+	state := newJobState()
+	if partialResults {
+		state.partials = a.startPartialSender(job)
+	}
+	stderrMarkers := newMarkerWriter(cappedLogs, state.handleMarker)
+
+	// The command could not be started : the runner went missing or is not executable, namespaces are not permitted, or
+	// most likely resources lack
+	startFailed := func(err error) runResult {
+		if state.partials != nil {
+			state.partials.close()
+		}
+		if logStream != nil {
+			logStream.close()
+		}
+		if ctx.Err() != nil {
+			// Cancelled before the command could start, there is no process to stop
+			return runResult{Success: false, Output: "null", Cancelled: true, Graceful: true, Reason: "cancelled"}
+		}
+
+		reason := "start_failed"
+		if _, lookErr := exec.LookPath(runner[0]); lookErr != nil {
+			jlog.Errorf("Runner %s can not be executed : %v\n", runner[0], lookErr)
+			reason = "runner_unavailable"
+		} else if isolateJobs && isIsolationError(err) {
+			// Most likely namespaces are not permitted on this host
+			jlog.Errorf("Could not start isolated job : %v\n", err)
+			return runResult{
+				Success: false,
+				Output:  "null",
+				Logs:    fmt.Sprintf("Could not start the job in isolated namespaces : %v", err),
+				Reason:  "isolation_failed",
+			}
+		} else {
+			jlog.Errorf("Could not start command : %v\n", err)
+		}
+		return runResult{
+			Success:              false,
+			Output:               "null",
+			Logs:                 fmt.Sprintf("Could not start the command : %v", err),
+			Reason:               reason,
+			StartResourcesLacked: reason == "start_failed" && isTransientStartError(err),
+		}
+	}
+
+	control, err := openControlPipe(state.handleControlMarker)
+	if err != nil {
+		return startFailed(err)
+	}
+
+	// Hash STDOUT as it streams, so the digest covers the full output whatever is retained of it
+	var outHash hash.Hash
+	if os.Getenv("ZETTO_HASH_OUTPUT") == "true" || featureEnabled("output-hash") {
+		outHash = sha256.New()
+		stdout = io.MultiWriter(cappedOut, outHash)
+	}
+
+	// Track the last output of the command, reported in its heartbeats
+	stdout = state.trackOutput(stdout)
+	stderr := state.trackOutput(stderrMarkers)
+
+	// Optionally watch for the command closing its STDOUT, which then tells the run is complete
+	var stdoutEOF *stdoutPipe
+	if completeOnStdoutEOF {
+		stdoutEOF, err = openStdoutPipe(stdout)
+		if err != nil {
+			control.closeWriter()
+			return startFailed(err)
+		}
+	}
+
+	// The API may cancel the run through its heartbeats or its control endpoint
+	ctx, cancelRun := context.WithCancel(ctx)
+	defer cancelRun()
+
+	// Done on timeout, with context.DeadlineExceeded as its cause, or once the run is cancelled. Its deadline is not
+	// fixed as the command may set its own timeout through its handshake, see runDeadline below
+	execCtx, cancelExec := context.WithCancelCause(ctx)
+	defer cancelExec(nil)
 
 	// Start the command
-	err := cmd.Start()
+	var queueWait time.Duration
+	if !job.claimedAt.IsZero() {
+		queueWait = time.Since(job.claimedAt)
+	}
+	var startedAt time.Time
+	var signaled int32
+	cmd, retries, err := startWithRetry(func() *exec.Cmd {
+		startedAt = time.Now()
+		cmd := exec.CommandContext(execCtx, runner[0], runner[1:]...)
+		cmd.Cancel = terminateOnCancel(cmd, &signaled)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		cmd.Env = jobEnv(job)
+		cmd.Dir = dir
+		if inputMode == inputModeStdin {
+			// Copied by exec while the command runs, whatever its pace of reading, then closed so it sees the end
+			cmd.Stdin = strings.NewReader(input)
+		}
+		cmd.ExtraFiles = []*os.File{control.writer}
+		// Run the command in its own process group, so that its descendants are killed along with it
+		cmd.SysProcAttr = withProcessGroup(jobSysProcAttr())
+		// Bound the wait for the output once the process exited, a descendant may hold the pipes open, and for the
+		// process once it was asked to terminate
+		cmd.WaitDelay = captureStallTimeout
+		if stdoutEOF != nil {
+			cmd.Stdout = stdoutEOF.writer
+		}
+		return cmd
+	})
+	control.closeWriter()
+	var stdoutClosed <-chan struct{}
+	if stdoutEOF != nil {
+		stdoutEOF.closeWriter()
+		stdoutClosed = stdoutEOF.eof
+	}
 	if err != nil {
-		log.Fatal(err)
+		return startFailed(err)
+	}
+
+	defer trackProcessGroup(cmd.Process.Pid)()
+	leaveCgroup := joinJobCgroup(job, cmd.Process.Pid)
+	defer leaveCgroup()
+
+	// Pinned right after the start, the processes the command spawns inherit its CPUs
+	if cpus := jobCPUs(job); cpus != nil {
+		if err := setCPUAffinity(cmd.Process.Pid, cpus); err != nil {
+			jlog.Errorf("Error setting the CPU affinity : %v\n", err)
+		}
 	}
 
+	stopHeartbeat := a.startHeartbeat(job, state, cancelRun)
+	stopRunControl := a.watchRunControl(job, cancelRun)
+
 	// Create a channel for it to notify its completion (with its exit code)
 	done := make(chan int)
 
+	// Set when the output could not be fully captured, or was held open by a descendant, only read once done fired
+	captureStalled := false
+	pipesHeld := false
+
 	// Asynchronous goroutine
 	go func() {
 		// Wait for the command to finish
 		err := cmd.Wait()
 		if err != nil {
-			if exitError, ok := err.(*exec.ExitError); ok {
+			if errors.Is(err, exec.ErrWaitDelay) {
+				// The process exited successfully, but a descendant held its output open : kill what is left of it
+				jlog.Warnf("Command exited but its output was held open, killing its remaining processes\n")
+				if err := killProcessGroup(cmd.Process.Pid); err != nil {
+					jlog.Errorf("Error killing the remaining processes : %v\n", err)
+				}
+				pipesHeld = true
+				done <- 0
+			} else if exitError, ok := err.(*exec.ExitError); ok {
 				// Standard exit error : notify the status through the channel
 				done <- exitError.ExitCode()
+			} else if execCtx.Err() != nil && errors.Is(err, execCtx.Err()) {
+				// Exited successfully once asked to terminate, the timeout or the cancellation is told by the context
+				done <- 0
 			} else {
-				// Something wrong happened, let's crash
-				log.Fatalf("cmd.Wait: %v", err)
+				// Something wrong happened while waiting, the run can not be trusted
+				jlog.Errorf("Error waiting for the command : %v\n", err)
+				done <- -1
 			}
 		} else {
 			// Finished without an error : notify the status zero through the channel
@@ -141,150 +523,800 @@ func execJob(job jobConfig) runResult {
 		close(done)
 	}()
 
-	// Setup a timer after which the command should be killed
-	timeoutDuration := job.Timeout
-	if timeoutDuration == 0 {
-		timeoutDuration = 15
-	}
-
-	timeout := time.NewTimer(time.Duration(timeoutDuration) * time.Second)
+	// Set the deadline of the run, after which the command is asked to terminate. Jobs come clamped from
+	// execWithRetries, the list call has its own timeout
+	deadline := startedAt.Add(time.Duration(requestedTimeout(job)) * time.Second)
+	runDeadline := time.AfterFunc(time.Until(deadline), func() {
+		cancelExec(context.DeadlineExceeded)
+	})
+	defer runDeadline.Stop()
 
 	// Prepare a variable into which the exist code will be stored
 	var exitCode int
+	result := runResult{
+		StartRetries: retries,
+		QueueWait:    queueWait,
+		Revision:     currentRevision(),
+	}
+
+	// Kill the process group and wait for the command. Should the output capture be stuck, report it rather than hanging
+	killAndWait := func() int {
+		if err := killProcessGroup(cmd.Process.Pid); err != nil {
+			jlog.Errorf("Error killing process : %v\n", err)
+		}
+		select {
+		case exitCode := <-done:
+			return exitCode
+		case <-time.After(captureStallTimeout):
+			jlog.Warnf("Output capture stalled after the kill\n")
+			captureStalled = true
+			return <-done
+		}
+	}
 
-	// Wait simultaneously for an execution end, or the timeout completion
-	select {
-	case exitCode = <-done:
-		// Execution ended, stop the timeout
-		if !timeout.Stop() {
-			<-timeout.C
+	// Stop the process gracefully once its context is done : exec sends SIGTERM, then SIGKILL once the grace period
+	// is over
+	stop := func() int {
+		if exitCode, exited := awaitTermination(job, done); exited {
+			return exitCode
 		}
+		jlog.Println("Killing process")
+		return killAndWait()
+	}
+
+	// Wait simultaneously for an execution end, the timeout completion, a cancellation, a timeout handshake, the end of STDOUT,
+	// or the output reaching its limit
+	var eofGrace <-chan time.Time
+	waiting := true
+	for waiting {
+		waiting = false
+		select {
+		case exitCode = <-done:
+			// Execution ended, stop the timeout
+			runDeadline.Stop()
+
+		case requested := <-state.timeoutRequests:
+			// The command declared its own timeout, counted from its start and within the configured max. It may only
+			// extend the deadline, the one of the job stands otherwise
+			if maxTimeout > 0 && requested > maxTimeout {
+				jlog.Warnf("Requested timeout %s is over the max, clamping to %s\n", requested, maxTimeout)
+				requested = maxTimeout
+			}
+			if requestedDeadline := startedAt.Add(requested); requestedDeadline.Before(deadline) {
+				jlog.Warnf("Ignoring timeout %s set by the command, shorter than the one of the job\n", requested)
+			} else if runDeadline.Stop() {
+				// Too late once the timeout fired, the command is already terminating
+				jlog.Println("Timeout set by the command to", requested)
+				deadline = requestedDeadline
+				runDeadline.Reset(time.Until(deadline))
+			}
+			waiting = true
+
+		case <-stdoutClosed:
+			// The command is done with its output, give it a little time to exit by itself
+			stdoutClosed = nil
+			eofGrace = time.After(stdoutEOFGrace)
+			waiting = true
 
-	case <-timeout.C:
-		// Timeout triggered, kill the process, and return an exit code of 143
-		log.Println("Execution timeout, killing process")
-		if err := cmd.Process.Kill(); err != nil {
-			log.Fatal("failed to kill process: ", err)
+		case <-eofGrace:
+			// Still running after closing its output : the run is complete, kill what is left of it
+			jlog.Println("Command closed its output but is still running, killing it")
+			runDeadline.Stop()
+			if err := killProcessGroup(cmd.Process.Pid); err != nil {
+				jlog.Errorf("Error killing process : %v\n", err)
+			}
+			<-done
+			exitCode = 0
+
+		case <-execCtx.Done():
+			if context.Cause(execCtx) == context.DeadlineExceeded {
+				// Timeout triggered, the process is asked to terminate, and killed if it does not within the grace period
+				jlog.Warnf("Execution timeout, terminating process\n")
+				events.record(job, "timed-out", "")
+				result.TimedOut = true
+				exitCode = stop()
+				break
+			}
+
+			// Cancelled, the process is asked to terminate unless it finished in the meantime. Being the only case
+			// handling the cancellation, a timeout or an output limit already stopping the process never gets a
+			// second kill
+			runDeadline.Stop()
+			result.Cancelled = true
+			result.Reason = "cancelled"
+			select {
+			case exitCode = <-done:
+				if atomic.LoadInt32(&signaled) == 0 {
+					jlog.Println("Execution cancelled, process already exited")
+					result.Graceful = true
+				} else {
+					jlog.Println("Execution cancelled, process terminated")
+				}
+			default:
+				jlog.Println("Execution cancelled, terminating process")
+				exitCode = stop()
+			}
+
+		case <-outputLimit.reached:
+			// Runaway output, stop the command rather than discarding its output for the rest of its timeout
+			stream, limit := "STDOUT", maxStdoutBytes
+			if cappedLogs.wasTruncated() {
+				stream, limit = "STDERR", maxStderrBytes
+			}
+			jlog.Warnf("%s of run %s over %d bytes, killing process\n", stream, job.ID, limit)
+			runDeadline.Stop()
+			result.Truncated = true
+			exitCode = killAndWait()
 		}
-		// Wait for the done channel, which should be triggered after the kill. Apparently this emits a -1 exit code
-		exitCode = <-done
+	}
+
+	result.Duration = time.Since(startedAt)
+	result.ExitCode = &exitCode
+
+	if pipesHeld {
+		result.PipesHeldOpen = true
+		if heldPipesMode == "fail" {
+			captureStalled = true
+		}
+	}
+
+	stopHeartbeat()
+	stopRunControl()
+	if stdoutEOF != nil {
+		// Kill the survivors of the command, such as a daemon it spawned, which may still hold its output
+		if err := killProcessGroup(cmd.Process.Pid); err != nil {
+			jlog.Errorf("Error killing the remaining processes : %v\n", err)
+		}
+		if !stdoutEOF.waitFor(captureStallTimeout) {
+			captureStalled = true
+		}
+	}
+	if !control.waitFor(captureStallTimeout) {
+		captureStalled = true
+	}
+	if state.partials != nil {
+		stderrMarkers.Flush()
+		state.partials.close()
 	}
 
 	// Fetch the command logs through STDERR
-	logStr := logBuf.String()
+	stderrMarkers.Flush()
+	if logStream != nil {
+		logStream.close()
+	}
+	result.Logs = normalizeText(logBuf.String())
+	result.Warnings = state.reportedWarnings()
 
-	// Return a failed run if the exit code is not zero
-	if exitCode != 0 {
-		log.Println("EXIT CODE", exitCode)
-		return runResult{
-			Success: false,
-			Output:  "null",
-			Logs:    logStr,
+	output := normalizeText(outBuf.String())
+	result.Metadata = extractMetadata(result.Logs, output)
+
+	if outHash != nil {
+		result.OutputSHA256 = hex.EncodeToString(outHash.Sum(nil))
+	}
+
+	// The limit may have been reached right before the command exited
+	if cappedOut.wasTruncated() {
+		result.TruncatedStreams = append(result.TruncatedStreams, "stdout")
+	}
+	if cappedLogs.wasTruncated() {
+		result.TruncatedStreams = append(result.TruncatedStreams, "stderr")
+	}
+	if len(result.TruncatedStreams) > 0 {
+		result.Truncated = true
+		result.Reason = "output_too_large"
+	}
+
+	// The output may be incomplete, the run can not be trusted
+	if captureStalled {
+		jlog.Warnf("Output capture stalled for run %s\n", job.ID)
+		// A runaway output is the root cause of a stall after its kill
+		if !result.Truncated {
+			result.Reason = "capture_stalled"
+		}
+	}
+
+	// Return a failed run if the exit code is not one of the successful ones
+	if !successExitCodes[exitCode] || result.Cancelled || captureStalled || result.Truncated {
+		jlog.Println("EXIT CODE", exitCode)
+		// Tells the agent's own kills from external ones, such as the OOM killer
+		result.Signal = terminationSignal(cmd.ProcessState)
+		result.Success = false
+		result.Output = "null"
+		// A command which exited by itself wrote its whole output, which may tell why it failed
+		if output != "" && exitCode >= 0 && !result.TimedOut && !result.Cancelled && !captureStalled && !result.Truncated {
+			result.Output = failureOutput(output)
 		}
+		return result
 	}
 
 	// Successful run : fetch the output through STDOUT, and return a successful run
-	outStr := outBuf.String()
-	return runResult{
-		Success: true,
-		Output:  outStr,
-		Logs:    logStr,
+	result.Success = true
+	result.Output = output
+	handleEmptyOutput(job, &result)
+	validateOutputJSON(job, &result)
+	return result
+}
+
+// Maximum random delay before notifying a run's result, spreading the notifies of runs finishing together. 0 disables it
+var notifyJitter time.Duration
+
+// Returned by notify when the API already recorded the run's result, which is then as good as delivered
+var errAlreadyCompleted = errors.New("Run already completed")
+
+// Build the notify payload of a run's result, as transformed by the operators. It is sent with an Idempotency-Key
+// header, see idempotencyKey, so the API can tell a retried delivery from a new result
+func notifyPayload(job jobConfig, result runResult) ([]byte, error) {
+	notify := jobNotify{
+		RunID:            job.ID,
+		Success:          result.Success,
+		Output:           result.Output,
+		Logs:             result.Logs,
+		OutputSHA256:     result.OutputSHA256,
+		StartRetries:     result.StartRetries,
+		Warnings:         result.Warnings,
+		QueueWaitMs:      result.QueueWait.Milliseconds(),
+		Reason:           result.Reason,
+		Cancelled:        result.Cancelled,
+		Signal:           result.Signal,
+		Metadata:         result.Metadata,
+		Labels:           labels,
+		Revision:         result.Revision,
+		Truncated:        result.Truncated,
+		TruncatedStreams: result.TruncatedStreams,
+		DurationMs:       result.Duration.Milliseconds(),
+		TimedOut:         result.TimedOut,
+		ExitCode:         result.ExitCode,
+
+		PipesHeldOpen: result.PipesHeldOpen,
 	}
+	if len(result.AttemptTimeouts) > 1 {
+		notify.AttemptTimeouts = result.AttemptTimeouts
+	}
+
+	payload, err := json.Marshal(notify)
+	if err != nil {
+		return nil, err
+	}
+
+	// Let the operators' transform redact, enrich or reshape the result
+	return transformPayload(payload)
 }
 
-// Notify the API of a run's result
-func notify(job jobConfig, result runResult) error {
-	hostname, err := os.Hostname()
+// Notify the API at baseURL of a run's result
+func (a *Agent) notify(ctx context.Context, baseURL string, job jobConfig, result runResult) error {
+	payload, err := notifyPayload(job, result)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	client := &http.Client{
-		Timeout: time.Second * 10,
+	runLog(job).Printf("Sending payload %s\n", payload)
+
+	// Large payloads, mostly logs, compress well and may be over the body size limits of proxies
+	upload := payload
+	compressed := compressNotify && len(payload) > compressThreshold
+	if compressed {
+		if upload, err = gzipPayload(payload); err != nil {
+			return err
+		}
 	}
 
-	notifyPayload := jobNotify{
-		RunID:   job.ID,
-		Success: result.Success,
-		Output:  result.Output,
-		Logs:    result.Logs,
+	req, err := a.newRequestTo(baseURL, "POST", "notify", bytes.NewBuffer(upload))
+	if err != nil {
+		return err
 	}
+	req = req.WithContext(ctx)
+	if compressed {
+		req.Header.Add("Content-Encoding", "gzip")
+	}
+	req.Header.Add("Idempotency-Key", idempotencyKey(job, result))
 
-	payload, err := json.Marshal(notifyPayload)
+	res, err := a.NotifyClient.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	defer res.Body.Close()
+
+	// The result was already recorded, most likely by an earlier delivery of the same run
+	if res.StatusCode == http.StatusConflict {
+		return errAlreadyCompleted
+	}
+
+	if res.StatusCode == http.StatusUnprocessableEntity {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		if bytes.Contains(body, []byte("unknown_command")) {
+			return errUnknownCommand
+		}
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return statusError{"Notify", res.StatusCode}
 	}
 
-	log.Printf("Sending payload %s\n", payload)
+	// The response may carry an instruction for the agent
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	handleNotifyResponse(body)
+
+	return nil
+}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s", os.Getenv("ZETTO_HOST"), "notify"), bytes.NewBuffer(payload))
+// Acknowledge a job cancellation to the API, so it knows whether the cancellation took effect
+func (a *Agent) cancelAck(job jobConfig, result runResult) error {
+	payload, err := json.Marshal(jobCancelAck{
+		RunID:    job.ID,
+		State:    "cancelled",
+		Graceful: result.Graceful,
+	})
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("ApiKey %s", os.Getenv("ZETTO_API_KEY")))
-	req.Header.Add("X-Runner-Name", hostname)
-	req.Header.Add("Content-Type", "application/json")
 
-	res, err := client.Do(req)
+	req, err := a.newRequest("POST", "cancel-ack", bytes.NewBuffer(payload))
 	if err != nil {
 		return err
 	}
 
+	res, err := a.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		return fmt.Errorf("Notify error %d", res.StatusCode)
+		return fmt.Errorf("Cancel ack error %d", res.StatusCode)
 	}
 
 	return nil
 }
 
+// Hand a claimed job back to the API without running it
+func (a *Agent) nack(job jobConfig, reason string) error {
+	payload, err := json.Marshal(jobNack{
+		RunID:  job.ID,
+		Reason: reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := a.newRequest("POST", "nack", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+
+	res, err := a.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Nack error %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// Execute a job and notify the API of its result
+func (a *Agent) runJob(ctx context.Context, job jobConfig) {
+	jlog := runLog(job)
+
+	// A job re-sent by the API after a lost notify is answered from the cache
+	runresult, cached := results.get(job.ID)
+	if cached {
+		jlog.Println("Reusing the cached result of run", job.ID)
+	} else {
+		started := time.Now()
+		events.record(job, "started", "")
+		runresult = runCoalesced(ctx, job, func() runResult {
+			return a.execWithRetries(ctx, job)
+		})
+		verifyResult(job, &runresult)
+		runresult.Nonce = newRunNonce()
+		switch {
+		case runresult.Cancelled:
+			events.record(job, "cancelled", "")
+		case runresult.Success:
+			events.record(job, "finished", "")
+		default:
+			events.record(job, "failed", runresult.Reason)
+		}
+		if !runresult.Cancelled {
+			results.put(job.ID, runresult)
+		}
+		recordRun(job, runresult, time.Since(started))
+		if !runresult.Cancelled {
+			circuits.record(job.Command, !runresult.Success, time.Now())
+		}
+	}
+
+	syslogJobLogs(job, runresult)
+
+	// Chatty commands are notified in batches
+	if summaries.handles(job.Command) {
+		summaries.add(job, runresult)
+		return
+	}
+
+	// Only delays the first attempt, retries have their own pace
+	if notifyJitter > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(notifyJitter))))
+	}
+
+	// Kept on disk until acknowledged, so the result survives a crash of the agent
+	spooled, err := spoolResult(job, runresult)
+	if err != nil {
+		jlog.Errorf("Error spooling job result : %v\n", err)
+	}
+
+	err = a.deliverResult(job, runresult)
+
+	if errors.Is(err, errAlreadyCompleted) {
+		jlog.Println("Run", job.ID, "was already completed")
+		err = nil
+	}
+
+	if errors.Is(err, errUnknownCommand) {
+		requestRelist(job.Command)
+		err = nil
+	}
+
+	// Rejected results are lost. Those the API failed to take stay in the spool, to be replayed while the agent keeps
+	// polling
+	if err != nil && isTransientNotifyError(err) {
+		if spooled == "" {
+			jlog.Errorf("Error notifying job result : %v, the result is lost\n", err)
+			return
+		}
+		jlog.Errorf("Error notifying job result : %v, keeping it in the spool\n", err)
+		keepSpooled(spooled)
+		return
+	}
+	if err != nil {
+		jlog.Errorf("Error notifying job result : %v\n", err)
+	}
+	if err := unspool(spooled); err != nil {
+		jlog.Errorf("Error removing spooled result : %v\n", err)
+	}
+
+	// Downstream consumers only hear of the results the API accepted
+	if err == nil {
+		publisher.add(job, runresult)
+	}
+
+	// Close the cancellation loop with the API
+	if runresult.Cancelled {
+		if err := a.cancelAck(job, runresult); err != nil {
+			jlog.Errorf("Error acknowledging job cancellation : %v\n", err)
+		}
+	}
+}
+
 func main() {
-	log.Print("Started")
+	validateJobs := flag.String("validate-jobs", "", "check the jobs of a JSON file, without running them, then exit")
+	commandsFile := flag.String("commands", "", "with -validate-jobs, file holding the command list, to check the jobs' commands")
+	showVersion := flag.Bool("version", false, "print the version, then exit")
+	flag.Parse()
+
+	// Before the configuration is checked, so it works without it
+	if *showVersion || flag.Arg(0) == "version" {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+
+	if *validateJobs != "" {
+		os.Exit(validateJobFile(*validateJobs, *commandsFile))
+	}
+
+	log.Print("Started ", versionString())
+	takeRestartEnv()
 
 	// Check availability of configuration
-	if os.Getenv("ZETTO_HOST") == "" {
-		log.Fatal("Missing ZETTO_HOST environment")
+	if err := loadConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if reportConfigFingerprint {
+		log.Println("Configuration fingerprint", configFingerprint)
+	}
+	agent, err := NewAgentFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Fail fast on an unreachable API or a rejected key, rather than in the middle of the loop
+	if preflightEnabled {
+		if err := agent.preflight(); err != nil {
+			log.Fatal("Preflight failed : ", err)
+		}
+		log.Println("Preflight succeeded")
+	}
+
+	// Nothing past this point runs in a dry run, which neither counts as a restart nor runs jobs
+	if dryRun {
+		os.Exit(agent.checkSetup())
+	}
+
+	if err := countRestart(); err != nil {
+		agentLog.Errorf("Error counting the restart : %v\n", err)
+	}
+
+	if resultCacheTTL > 0 {
+		results = newResultCache(resultCacheTTL, resultCacheSize)
 	}
 
-	if os.Getenv("ZETTO_API_KEY") == "" {
-		log.Fatal("Missing ZETTO_API_KEY environment")
+	if maxConcurrentPolls > 0 {
+		pollGate = make(chan struct{}, maxConcurrentPolls)
 	}
 
-	if os.Getenv("ZETTO_RUNNER") == "" {
-		log.Fatal("Missing ZETTO_RUNNER environment")
+	if maxJobsPerMinute > 0 {
+		jobRate = newJobRateLimiter(maxJobsPerMinute)
+	}
+
+	if mq != nil {
+		publisher = startMQPublisher(mq, mqTopic)
+	}
+
+	if len(summaryCommands) > 0 {
+		summaries = newSummaryBatcher(agent, summaryCommands, summaryInterval, summarySize)
+	}
+
+	handleSignals()
+	handleBrokenPipes()
+	handleRestarts()
+
+	if controlSocketPath != "" {
+		if err := serveControlSocket(); err != nil {
+			log.Fatal("Could not open the control socket : ", err)
+		}
+	}
+
+	if metricsAddr != "" {
+		if err := serveMetrics(); err != nil {
+			log.Fatal("Could not serve the metrics : ", err)
+		}
+		log.Println("Serving metrics on", metricsAddr)
 	}
 
-	pollingInterval, err := strconv.Atoi(os.Getenv("ZETTO_POLLING_INTERVAL"))
+	if healthAddr != "" {
+		if err := serveHealth(); err != nil {
+			log.Fatal("Could not serve the health checks : ", err)
+		}
+		log.Println("Serving health checks on", healthAddr)
+	}
+
+	// The listeners are taken over, the process which re-executed the agent can stop accepting on them
+	signalRestartReady()
+
+	log.Printf("Running up to %d jobs concurrently (hard limit %d)\n", softConcurrency, hardConcurrency)
+	limits = newConcurrencyLimits(softConcurrency, hardConcurrency)
+
+	// Start a job in the background, the caller must have waited for a slot.
+	// An optional random stagger between job starts smoothes the resource ramp of a burst of jobs
+	startJob := func(job jobConfig) {
+		if agent.nackIfStale(job) {
+			return
+		}
+		if jobRate != nil {
+			jobRate.wait()
+		}
+		if running, _ := limits.status(); startStagger > 0 && running > 0 {
+			time.Sleep(time.Duration(rand.Int63n(int64(startStagger))))
+		}
+		// The slot of its command first, so a job waiting for it never holds a global one. Saturated commands are not
+		// polled for, only a job the API sent regardless waits here
+		releaseCommandSlot, ok := acquireCommandSlot(shutdownCtx, job)
+		if !ok {
+			queue.leave(job)
+			if err := agent.nack(job, "shutdown"); err != nil {
+				runLog(job).Errorf("Error nacking job : %v\n", err)
+			}
+			return
+		}
+		limits.acquire()
+		queue.leave(job)
+		go func() {
+			defer releaseCommandSlot()
+			defer limits.release()
+			agent.runJob(jobsCtx, job)
+		}()
+	}
+
+	// Optional debouncing : claimed jobs wait a little, and are superseded by newer jobs with the same key
+	var debounce *debouncer
+	if debounceDelay > 0 {
+		debounce = newDebouncer(debounceDelay, debounceKey)
+	}
+
+	// Results which were not delivered before the agent last stopped go first. After a graceful restart the previous
+	// process still delivers its own
+	if spoolDir != "" && !reexecuted() {
+		removeSpoolLeftovers()
+		agent.replaySpool()
+	}
+	if spoolDir != "" {
+		go agent.replaySpoolPeriodically()
+	}
+
+	// Commands sent with each poll, refreshed while the agent runs. The runner has to list them at startup
+	commands, err := agent.getCommandsList()
 	if err != nil {
-		log.Println("Could not parse env ZETTO_POLLING_INTERVAL, defaulting to 10 seconds")
-		pollingInterval = 10
+		log.Fatal(err)
 	}
 
-	// TODO : fetch available jobs in order to send them with hre polling request
-	commands := getCommandsList()
+	// Delay of the first poll after an outage, see backoff.succeeded. An unreachable API backs off further than a failing
+	// one
+	pollBackoff := newBackoff(pollingInterval, maxPollBackoff)
+	unreachableBackoff := newBackoff(pollingInterval, maxUnreachableBackoff)
+
+	// Loop until the agent is asked to shut down
+	for !shuttingDown() {
+		// Checked between polls only, so it never interrupts a running job
+		if maxRuntime > 0 && uptime() >= maxRuntime {
+			log.Printf("Max runtime of %s reached, exiting once the running jobs are done\n", maxRuntime)
+			requestShutdown()
+			break
+		}
+
+		// Re-sync the advertised commands, periodically or after a drift was detected
+		if relistDue() {
+			if relisted, err := agent.getCommandsList(); err != nil {
+				agentLog.Errorf("Error refreshing the commands list : %v, keeping the current one\n", err)
+			} else {
+				if relisted != commands {
+					log.Println("Commands list changed :", relisted)
+				}
+				commands = relisted
+			}
+		}
+
+		// Run the debounced jobs which were not superseded in time
+		if debounce != nil {
+			for _, job := range debounce.ready(time.Now()) {
+				limits.waitForSlot()
+				startJob(job)
+			}
+		}
+
+		// Stop claiming while the hard limit is reached
+		if _, regime := limits.status(); regime == regimeSaturated {
+			agent.setBusy("saturated")
+		}
+		limits.waitForSlot()
+
+		// Back off claiming while file descriptors run low, rather than failing to start the command
+		if !fdsAvailable() {
+			agent.setBusy("fds_exhausted")
+			sleepUnlessShutdown(pollingInterval)
+			continue
+		}
+
+		// Stop claiming while the spool is full, rather than dropping results. Replaying it is what makes room
+		if spoolFull() {
+			agent.replaySpool()
+		}
+		if spoolFull() {
+			agentLog.Warnf("Spool full, waiting for results to be delivered\n")
+			agent.setBusy("spool_full")
+			sleepUnlessShutdown(pollingInterval)
+			continue
+		}
+		agent.setBusy("")
+
+		// The shutdown may have started while waiting for a slot
+		if shuttingDown() {
+			break
+		}
+
+		// Claim nothing while the server asked for a pause, still running the debounced jobs meanwhile
+		if paused := claimsPausedFor(); paused > 0 {
+			if paused > pollingInterval {
+				paused = pollingInterval
+			}
+			sleepUnlessShutdown(paused)
+			continue
+		}
+
+		// Claim no job before the rate limit lets it start
+		if jobRate != nil {
+			jobRate.waitReady()
+			if shuttingDown() {
+				break
+			}
+		}
 
-	// Infinite loop
-	for {
-		jobconfig, err := poll(commands)
+		polledAt := time.Now()
+		jobconfig, err := agent.poll(availableCommands(commands))
+		recordPoll(err)
 
 		if err != nil {
-			log.Println("Error fetching a job :", err)
-			os.Exit(1)
+			class := classifyError(err)
+			// recordPoll counted the failure, the health server reads the same count
+			failures := int(atomic.LoadInt32(&pollFailures))
+			if maxPollFailures > 0 && failures >= maxPollFailures {
+				agentLog.Errorf("Error fetching a job (%s) : %v, giving up after %d consecutive failures\n", class, err, failures)
+				shutdownWithError(1)
+				break
+			}
+
+			var delay time.Duration
+			switch class {
+			case errorUnreachable:
+				delay = unreachableBackoff.failed() + unreachableBackoff.spread()
+			case errorClient:
+				// Waiting longer will not change the API's answer, so the rejection is reported on every poll
+				delay = pollingInterval
+			default:
+				delay = pollBackoff.failed() + pollBackoff.spread()
+			}
+			agentLog.Errorf("Error fetching a job (%s) : %v, retrying in %s\n", class, err, delay)
+			sleepUnlessShutdown(delay)
+			continue
+		}
+
+		if pollBackoff.failures > 0 || unreachableBackoff.failures > 0 {
+			log.Println("Polling recovered")
 		}
+		pollBackoff.succeeded()
+		unreachableBackoff.succeeded()
 
 		if jobconfig == nil {
+			// The long poll already waited for a job, unless the API answered right away
+			if longPoll && time.Since(polledAt) >= minLongPollHold {
+				log.Println("No job found, polling again")
+				continue
+			}
+
 			log.Println("No job found, waiting")
-			// Todo : sleep here
-			time.Sleep(time.Duration(pollingInterval) * time.Second)
+			sleep := idlePollInterval()
+			if debounce != nil {
+				// Do not oversleep a pending debounced job
+				if due, pending := debounce.nextDue(time.Now()); pending && due < sleep {
+					sleep = due
+				}
+			}
+			sleepUnlessShutdown(sleep)
+			continue
+		}
+
+		jobsPolledTotal.inc(jobconfig.Command)
+
+		// Decline the commands whose circuit is open, they would most likely fail
+		if !circuits.allow(jobconfig.Command, time.Now()) {
+			runLog(*jobconfig).Warnf("Circuit of command %s is open, declining job %s\n", jobconfig.Command, jobconfig.ID)
+			if err := agent.nack(*jobconfig, "circuit_open"); err != nil {
+				runLog(*jobconfig).Errorf("Error nacking job : %v\n", err)
+			}
 			continue
 		}
 
-		runresult := execJob(*jobconfig)
+		queue.enter(*jobconfig)
+		events.record(*jobconfig, "claimed", "")
 
-		err = notify(*jobconfig, runresult)
+		if debounce != nil {
+			if superseded := debounce.add(*jobconfig, time.Now()); superseded != nil {
+				runLog(*superseded).Println("Job", superseded.ID, "superseded by", jobconfig.ID)
+				queue.leave(*superseded)
+				if err := agent.nack(*superseded, "superseded"); err != nil {
+					runLog(*superseded).Errorf("Error nacking job : %v\n", err)
+				}
+			}
+			continue
+		}
 
-		if err != nil {
-			log.Println("Error notifying job result :", err)
-			os.Exit(1)
+		startJob(*jobconfig)
+	}
+
+	// Give back the debounced jobs, and let the running ones finish and notify their results
+	if debounce != nil {
+		for _, job := range debounce.flush() {
+			queue.leave(job)
+			if err := agent.nack(job, "shutdown"); err != nil {
+				runLog(job).Errorf("Error nacking job : %v\n", err)
+			}
 		}
 	}
+	limits.waitIdle()
+	waitLameDuck()
+
+	log.Println("Shutdown complete")
+	exit(int(atomic.LoadInt32(&shutdownCode)))
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Use a /bin/sh script as the runner of the test's jobs, called as runner <command> <input>
+func useRunner(t *testing.T, script string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "runner.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ZETTO_RUNNER", path)
+}
+
+func TestExecJobExit(t *testing.T) {
+	useRunner(t, `
+case $1 in
+  ok) echo "{\"got\": $2}"; echo "working" >&2;;
+  fail) echo '{"error": "quota"}'; echo "boom" >&2; exit 3;;
+esac
+`)
+	agent := &Agent{}
+
+	result := agent.execJob(context.Background(), jobConfig{ID: "r1", Command: "ok", Input: "7", Timeout: 5})
+	if !result.Success || result.Output != "{\"got\": 7}\n" || result.Logs != "working\n" {
+		t.Errorf("normal exit : got success %v, output %q, logs %q", result.Success, result.Output, result.Logs)
+	}
+	if result.ExitCode == nil || *result.ExitCode != 0 || result.TimedOut || result.Cancelled {
+		t.Errorf("normal exit : got exit code %v, timed out %v, cancelled %v", result.ExitCode, result.TimedOut, result.Cancelled)
+	}
+
+	result = agent.execJob(context.Background(), jobConfig{ID: "r2", Command: "fail", Input: "1", Timeout: 5})
+	if result.Success || result.ExitCode == nil || *result.ExitCode != 3 {
+		t.Errorf("non-zero exit : got success %v, exit code %v", result.Success, result.ExitCode)
+	}
+	if result.Output != "{\"error\": \"quota\"}\n" || result.Logs != "boom\n" || result.TimedOut || result.Signal != "" {
+		t.Errorf("non-zero exit : got output %q, logs %q, timed out %v, signal %q", result.Output, result.Logs, result.TimedOut, result.Signal)
+	}
+}
+
+func TestExecJobTimeout(t *testing.T) {
+	defer func(saved time.Duration) { killGrace = saved }(killGrace)
+	killGrace = 500 * time.Millisecond
+
+	useRunner(t, `
+case $1 in
+  sleep) sleep 30;;
+  stubborn) trap "" TERM; sleep 30;;
+esac
+`)
+	agent := &Agent{}
+
+	tests := []struct {
+		command string
+		signal  string
+		// The timeout of 1s, plus the grace period when SIGTERM is ignored
+		minDuration time.Duration
+	}{
+		{"sleep", "SIGTERM", time.Second},
+		{"stubborn", "SIGKILL", time.Second + killGrace},
+	}
+	for _, test := range tests {
+		t.Run(test.command, func(t *testing.T) {
+			result := agent.execJob(context.Background(), jobConfig{ID: test.command, Command: test.command, Input: "1", Timeout: 1})
+			if result.Success || !result.TimedOut || result.Cancelled {
+				t.Errorf("got success %v, timed out %v, cancelled %v", result.Success, result.TimedOut, result.Cancelled)
+			}
+			if result.Signal != test.signal {
+				t.Errorf("got signal %q, want %s", result.Signal, test.signal)
+			}
+			if result.Duration < test.minDuration || result.Duration > test.minDuration+5*time.Second {
+				t.Errorf("got a duration of %s, want about %s", result.Duration, test.minDuration)
+			}
+		})
+	}
+}
+
+func TestExecJobHandshake(t *testing.T) {
+	useRunner(t, `
+echo "ZETTO_TIMEOUT: $2" >&3
+sleep 2
+echo '"done"'
+`)
+	agent := &Agent{}
+
+	// The handshake moves the deadline of 1s past the runtime of 2s
+	result := agent.execJob(context.Background(), jobConfig{ID: "longer", Command: "hs", Input: "4", Timeout: 1})
+	if !result.Success || result.TimedOut || result.Output != "\"done\"\n" {
+		t.Errorf("extended deadline : got success %v, timed out %v, output %q", result.Success, result.TimedOut, result.Output)
+	}
+
+	// A handshake can not bring the deadline closer
+	result = agent.execJob(context.Background(), jobConfig{ID: "shorter", Command: "hs", Input: "1", Timeout: 5})
+	if !result.Success || result.TimedOut {
+		t.Errorf("shorter handshake : got success %v, timed out %v", result.Success, result.TimedOut)
+	}
+}
+
+func TestExecJobCancelled(t *testing.T) {
+	defer func(saved time.Duration) { runControlInterval = saved }(runControlInterval)
+	runControlInterval = 100 * time.Millisecond
+
+	useRunner(t, "sleep 30\n")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/runs/c1/control" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintln(w, `{"action": "cancel"}`)
+	}))
+	defer server.Close()
+	agent := &Agent{BaseURL: server.URL, Client: server.Client()}
+
+	started := time.Now()
+	result := agent.execJob(context.Background(), jobConfig{ID: "c1", Command: "sleep", Input: "1", Timeout: 20})
+	if result.Success || !result.Cancelled || result.TimedOut || result.Reason != "cancelled" {
+		t.Errorf("got success %v, cancelled %v, timed out %v, reason %q", result.Success, result.Cancelled, result.TimedOut, result.Reason)
+	}
+	if result.Signal != "SIGTERM" {
+		t.Errorf("got signal %q, want SIGTERM", result.Signal)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("cancelled after %s", elapsed)
+	}
+
+	// Cancelled by the agent itself, such as on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	result = agent.execJob(ctx, jobConfig{ID: "c2", Command: "sleep", Input: "1", Timeout: 20})
+	if !result.Cancelled || result.TimedOut || result.Graceful {
+		t.Errorf("shutdown : got cancelled %v, timed out %v, graceful %v", result.Cancelled, result.TimedOut, result.Graceful)
+	}
+}
+
+func TestExecJobRunnerUnavailable(t *testing.T) {
+	t.Setenv("ZETTO_RUNNER", filepath.Join(t.TempDir(), "missing"))
+	api := newFakeAPI(t)
+	api.addJobs(`{"id": "missing-runner", "command": "echo", "input": "1"}`)
+
+	// Reported as a failed run, the agent carries on
+	api.pollAndRun(t, api.agent())
+
+	notifies := api.notifies(t)
+	if len(notifies) != 1 {
+		t.Fatalf("got %d notifies, want 1", len(notifies))
+	}
+	notify := notifies[0]
+	if notify.Success || notify.Reason != "runner_unavailable" || notify.Output != "null" {
+		t.Errorf("got success %v, reason %q, output %q", notify.Success, notify.Reason, notify.Output)
+	}
+	if !strings.Contains(notify.Logs, "Could not start the command") || !strings.Contains(notify.Logs, "missing") {
+		t.Errorf("got logs %q, want the start error", notify.Logs)
+	}
+
+	// Not executable
+	path := filepath.Join(t.TempDir(), "runner.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\necho 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ZETTO_RUNNER", path)
+	result := api.agent().execJob(context.Background(), jobConfig{ID: "not-executable", Command: "echo", Input: "1"})
+	if result.Success || result.Reason != "runner_unavailable" {
+		t.Errorf("not executable : got success %v, reason %q", result.Success, result.Reason)
+	}
+}
+
+func TestPollMalformedJob(t *testing.T) {
+	api := newFakeAPI(t)
+	api.addJobs(`{"id": "truncat`, `<html>Bad gateway</html>`, `{"id": "valid", "command": "echo"}`)
+	agent := api.agent()
+
+	for i := 0; i < 2; i++ {
+		job, err := agent.poll(`["echo"]`)
+		if err == nil || job != nil {
+			t.Fatalf("got job %v and error %v, want an error", job, err)
+		}
+		if !strings.HasPrefix(err.Error(), "Malformed job") {
+			t.Errorf("got error %q", err)
+		}
+	}
+
+	// The agent keeps polling
+	job, err := agent.poll(`["echo"]`)
+	if err != nil || job == nil || job.ID != "valid" {
+		t.Errorf("got job %v and error %v after the malformed ones", job, err)
+	}
+}
+
+func TestExecJobCaptureStall(t *testing.T) {
+	defer func(saved time.Duration) { captureStallTimeout = saved }(captureStallTimeout)
+	captureStallTimeout = 300 * time.Millisecond
+
+	useRunner(t, `
+case $1 in
+  flood) head -c 4000000 /dev/zero | tr '\0' a; head -c 4000000 /dev/zero | tr '\0' b >&2;;
+  held) setsid sleep 5 & echo '"held"';;
+  heldslow) setsid sleep 5 & sleep 30;;
+esac
+`)
+	agent := &Agent{}
+
+	// Far over the pipe buffers, drained while the command writes
+	result := agent.execJob(context.Background(), jobConfig{ID: "flood", Command: "flood", Timeout: 10})
+	if !result.Success || len(result.Output) != 4000000 || len(result.Logs) != 4000000 {
+		t.Errorf("flood : got success %v, %d bytes of output and %d of logs", result.Success, len(result.Output), len(result.Logs))
+	}
+
+	// A descendant out of the process group holds the output open after the command exited
+	started := time.Now()
+	result = agent.execJob(context.Background(), jobConfig{ID: "held", Command: "held", Timeout: 10})
+	if result.Success || result.Reason != "capture_stalled" || !result.PipesHeldOpen {
+		t.Errorf("held : got success %v, reason %q, pipes held open %v", result.Success, result.Reason, result.PipesHeldOpen)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("held : the run took %s", elapsed)
+	}
+
+	// Same past the timeout, the command being killed
+	started = time.Now()
+	result = agent.execJob(context.Background(), jobConfig{ID: "heldslow", Command: "heldslow", Timeout: 1})
+	if result.Success || !result.TimedOut || result.Reason != "capture_stalled" {
+		t.Errorf("held past the timeout : got success %v, timed out %v, reason %q", result.Success, result.TimedOut, result.Reason)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("held past the timeout : the run took %s", elapsed)
+	}
+}
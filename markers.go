@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Time given to a command's pipes to be drained once it exited or was killed, before giving up on their content
+var captureStallTimeout = 10 * time.Second
+
+// Outcome of a run whose command exited while a descendant still held its output open past captureStallTimeout :
+// "fail" reports it as capture_stalled, "proceed" keeps the output captured until then
+var heldPipesMode = "fail"
+
+// Lines longer than this can not be markers, and are passed through without waiting for their end
+const maxMarkerLine = 64 * 1024
+
+// Writer splitting a stream into lines, handing "ZETTO_<NAME>: <value>" marker lines to a handler and passing other lines through
+type markerWriter struct {
+	mu      sync.Mutex
+	out     io.Writer
+	partial []byte
+
+	// Returns false when the marker is unknown, in which case the line is passed through
+	handle func(name string, value string) bool
+}
+
+func newMarkerWriter(out io.Writer, handle func(name string, value string) bool) *markerWriter {
+	return &markerWriter{
+		out:    out,
+		handle: handle,
+	}
+}
+
+func (w *markerWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.partial = append(w.partial, p...)
+	for {
+		end := bytes.IndexByte(w.partial, '\n')
+		if end < 0 {
+			break
+		}
+
+		line := w.partial[:end+1]
+		w.partial = w.partial[end+1:]
+		if err := w.writeLine(line); err != nil {
+			return len(p), err
+		}
+	}
+
+	// Give up on an overlong line, it is regular output
+	if len(w.partial) > maxMarkerLine {
+		_, err := w.out.Write(w.partial)
+		w.partial = nil
+		if err != nil {
+			return len(p), err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Pass through the last line if it did not end with a newline
+func (w *markerWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.partial) == 0 {
+		return nil
+	}
+
+	err := w.writeLine(w.partial)
+	w.partial = nil
+	return err
+}
+
+func (w *markerWriter) writeLine(line []byte) error {
+	text := strings.TrimRight(string(line), "\r\n")
+	if strings.HasPrefix(text, "ZETTO_") {
+		if sep := strings.Index(text, ":"); sep > 0 {
+			if w.handle(text[len("ZETTO_"):sep], strings.TrimSpace(text[sep+1:])) {
+				return nil
+			}
+		}
+	}
+
+	_, err := w.out.Write(line)
+	return err
+}
+
+// Pipe passed to the command as fd 3, on which it can write markers without mixing them with its logs
+type controlPipe struct {
+	reader *os.File
+	writer *os.File
+	done   chan struct{}
+}
+
+// Open the control pipe of a command, to be set as its first extra file. Its markers are given to the handler
+func openControlPipe(handle func(name string, value string) bool) (*controlPipe, error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := &controlPipe{
+		reader: reader,
+		writer: writer,
+		done:   make(chan struct{}),
+	}
+
+	// Only markers are expected on the control pipe, anything else is dropped
+	go func() {
+		markers := newMarkerWriter(io.Discard, handle)
+		io.Copy(markers, reader)
+		markers.Flush()
+		reader.Close()
+		close(pipe.done)
+	}()
+
+	return pipe, nil
+}
+
+// Release the agent's copy of the write end once the command started (or failed to), so the reader sees the end of the stream
+func (p *controlPipe) closeWriter() {
+	p.writer.Close()
+}
+
+// Wait for the command and its descendants to close the pipe, giving up after the timeout. Returns false when it gave up
+func (p *controlPipe) waitFor(timeout time.Duration) bool {
+	return waitForPipe(p.done, p.reader, timeout)
+}
+
+// Wait for a pipe's reading to end, closing its read end to interrupt it after the timeout
+func waitForPipe(done chan struct{}, reader *os.File, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		reader.Close()
+		<-done
+		return false
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Address the metrics are served on for Prometheus to scrape, empty when disabled
+var metricsAddr string
+
+// Counter split by label values, rendered in the Prometheus text format
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: map[string]float64{},
+	}
+}
+
+// Increment the counter for the given label values, in the order of the labels
+func (c *counterVec) inc(values ...string) {
+	key := renderLabels(c.labels, values)
+
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %g\n", c.name, key, c.values[key])
+	}
+}
+
+// Histogram with fixed buckets, rendered in the Prometheus text format
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name string, help string, buckets []float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", h.name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// Gauge whose value is read when rendering, in the Prometheus text format
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func newGaugeFunc(name string, help string, value func() float64) *gaugeFunc {
+	return &gaugeFunc{
+		name:  name,
+		help:  help,
+		value: value,
+	}
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	fmt.Fprintf(w, "%s %g\n", g.name, g.value())
+}
+
+// Render label pairs such as {command="build",outcome="success"}
+func renderLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=%q", name, value)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Agent metrics
+var (
+	jobsPolledTotal = newCounterVec("zetto_jobs_polled_total", "Jobs claimed from the API, by command", "command")
+	jobsTotal       = newCounterVec("zetto_jobs_total", "Jobs executed, by command and outcome", "command", "outcome")
+	jobDuration     = newHistogram("zetto_job_duration_seconds", "Execution duration of jobs", []float64{0.1, 0.5, 1, 5, 15, 60, 300, 900, 3600})
+	jobQueueWait    = newHistogram("zetto_job_queue_wait_seconds", "Time jobs waited between their claim and their start", []float64{0.01, 0.1, 0.5, 1, 5, 15, 60, 300})
+
+	sigtermIgnoredTotal = newCounterVec("zetto_sigterm_ignored_total", "Commands which did not exit on SIGTERM within the grace period, by command", "command")
+
+	queueDepth = newGaugeFunc("zetto_queue_depth", "Claimed jobs which did not start yet", func() float64 {
+		depth, _ := queue.status(time.Now())
+		return float64(depth)
+	})
+	runningJobs = newGaugeFunc("zetto_running_jobs", "Jobs currently running", func() float64 {
+		if limits == nil {
+			return 0
+		}
+		running, _ := limits.status()
+		return float64(running)
+	})
+	overSoftConcurrency = newGaugeFunc("zetto_over_soft_concurrency", "1 while the running jobs are over the soft concurrency limit, or at the hard one", func() float64 {
+		if limits == nil {
+			return 0
+		}
+		if _, regime := limits.status(); regime != regimeNormal {
+			return 1
+		}
+		return 0
+	})
+	openFDs = newGaugeFunc("zetto_open_fds", "File descriptors open by the agent", func() float64 {
+		open, _ := openFDCount()
+		return float64(open)
+	})
+
+	queueOldestAge = newGaugeFunc("zetto_queue_oldest_age_seconds", "Time the oldest queued job has been waiting to start", func() float64 {
+		_, oldest := queue.status(time.Now())
+		return oldest.Seconds()
+	})
+)
+
+// Write every metric in the Prometheus text format
+func writeMetrics(w io.Writer) {
+	jobsPolledTotal.write(w)
+	jobsTotal.write(w)
+	jobDuration.write(w)
+	jobQueueWait.write(w)
+	runningJobs.write(w)
+	overSoftConcurrency.write(w)
+	// Only known on Linux
+	if _, known := openFDCount(); known {
+		openFDs.write(w)
+	}
+	sigtermIgnoredTotal.write(w)
+	circuits.write(w)
+	queueDepth.write(w)
+	queueOldestAge.write(w)
+}
+
+// Account for a finished run
+func recordRun(job jobConfig, result runResult, duration time.Duration) {
+	outcome := "success"
+	switch {
+	case result.Cancelled:
+		outcome = "cancelled"
+	case result.TimedOut:
+		outcome = "timeout"
+	case !result.Success:
+		outcome = "failure"
+	}
+
+	jobsTotal.inc(job.Command, outcome)
+	jobDuration.observe(duration.Seconds())
+	jobQueueWait.observe(result.QueueWait.Seconds())
+}
+
+// Serve the metrics on metricsAddr, in the background so scrapes never hold up the poll loop
+func serveMetrics() error {
+	listener, _, err := listen("metrics", "tcp", metricsAddr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			agentLog.Errorf("Metrics server stopped : %v\n", err)
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Client of the message queue the completion records are published to, and their topic, nil when disabled
+var (
+	mq      mqClient
+	mqTopic string
+)
+
+// Records waiting to be published, past which new ones are dropped
+const mqBufferSize = 256
+
+// Bound of every exchange with the message queue
+const mqTimeout = 10 * time.Second
+
+// Bound of the publication of all the pending records when exiting
+var mqFlushTimeout = mqTimeout
+
+// Client of a message queue protocol
+type mqClient interface {
+	// Publish a record to a topic, connecting first if needed
+	publish(topic string, payload []byte) error
+
+	// Drop the connection, the next publish reconnects
+	close()
+}
+
+// Build the client of the protocol named by the URL's scheme
+func newMQClient(rawURL string) (mqClient, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch parsed.Scheme {
+	case "redis":
+		return newRedisStream(parsed), nil
+	default:
+		return nil, fmt.Errorf("Unsupported message queue scheme %q", parsed.Scheme)
+	}
+}
+
+// Publishes the completion records in the background, so the message queue never holds up the runs
+type mqPublisher struct {
+	client mqClient
+	topic  string
+	queue  chan []byte
+	done   chan struct{}
+}
+
+// Publisher of the completion records, nil when disabled
+var publisher *mqPublisher
+
+func startMQPublisher(client mqClient, topic string) *mqPublisher {
+	p := &mqPublisher{
+		client: client,
+		topic:  topic,
+		queue:  make(chan []byte, mqBufferSize),
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		for payload := range p.queue {
+			if err := p.client.publish(p.topic, payload); err != nil {
+				agentLog.Errorf("Error publishing to the message queue : %v\n", err)
+				p.client.close()
+			}
+		}
+		p.client.close()
+		close(p.done)
+	}()
+
+	return p
+}
+
+// Queue the completion record of a run whose result was delivered. Records are dropped while the buffer is full
+func (p *mqPublisher) add(job jobConfig, result runResult) {
+	if p == nil {
+		return
+	}
+
+	payload, err := notifyPayload(job, result)
+	if err != nil {
+		runLog(job).Errorf("Error building the completion record : %v\n", err)
+		return
+	}
+
+	select {
+	case p.queue <- payload:
+	default:
+		runLog(job).Warnf("Too many pending completion records, dropping the one of run %s\n", job.ID)
+	}
+}
+
+// Publish the queued records before exiting, within mqFlushTimeout. Those left then are dropped
+func (p *mqPublisher) flush() {
+	close(p.queue)
+
+	timer := time.NewTimer(mqFlushTimeout)
+	defer timer.Stop()
+	select {
+	case <-p.done:
+	case <-timer.C:
+		agentLog.Warnf("Message queue too slow, dropping %d pending completion records\n", len(p.queue))
+	}
+}
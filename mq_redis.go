@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Appends the records to a Redis stream, with XADD <topic> * payload <record>
+type redisStream struct {
+	address  string
+	username string
+	password string
+	database string
+
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Client of redis://[user:password@]host:port[/database]
+func newRedisStream(parsed *url.URL) *redisStream {
+	stream := &redisStream{
+		address:  parsed.Host,
+		database: strings.TrimPrefix(parsed.Path, "/"),
+	}
+	if parsed.Port() == "" {
+		stream.address = net.JoinHostPort(parsed.Hostname(), "6379")
+	}
+	if parsed.User != nil {
+		stream.username = parsed.User.Username()
+		stream.password, _ = parsed.User.Password()
+	}
+
+	return stream
+}
+
+func (r *redisStream) connect() error {
+	conn, err := net.DialTimeout("tcp", r.address, mqTimeout)
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+	r.reader = bufio.NewReader(conn)
+
+	if r.password != "" {
+		args := []string{"AUTH", r.password}
+		if r.username != "" {
+			args = []string{"AUTH", r.username, r.password}
+		}
+		if _, err := r.command(args...); err != nil {
+			return err
+		}
+	}
+	if r.database != "" {
+		if _, err := r.command("SELECT", r.database); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *redisStream) publish(topic string, payload []byte) error {
+	if r.conn == nil {
+		if err := r.connect(); err != nil {
+			return err
+		}
+	}
+
+	_, err := r.command("XADD", topic, "*", "payload", string(payload))
+	return err
+}
+
+func (r *redisStream) close() {
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+}
+
+// Send a command, and read its reply
+func (r *redisStream) command(args ...string) (string, error) {
+	r.conn.SetDeadline(time.Now().Add(mqTimeout))
+
+	var request strings.Builder
+	fmt.Fprintf(&request, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&request, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := r.conn.Write([]byte(request.String())); err != nil {
+		return "", err
+	}
+
+	return r.reply()
+}
+
+// Read a simple reply : a status, an error, an integer or a bulk string
+func (r *redisStream) reply() (string, error) {
+	line, err := r.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", fmt.Errorf("Empty Redis reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", fmt.Errorf("Redis error : %s", line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", fmt.Errorf("Malformed Redis reply %q", line)
+		}
+		if size < 0 {
+			return "", nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r.reader, data); err != nil {
+			return "", err
+		}
+		return string(data[:size]), nil
+	default:
+		return "", fmt.Errorf("Unexpected Redis reply %q", line)
+	}
+}
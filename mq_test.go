@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Message queue client taking delay to publish each record
+type slowMQ struct {
+	delay     time.Duration
+	published int32
+}
+
+func (m *slowMQ) publish(topic string, payload []byte) error {
+	time.Sleep(m.delay)
+	atomic.AddInt32(&m.published, 1)
+	return nil
+}
+
+func (m *slowMQ) close() {}
+
+func TestMQFlushDeadline(t *testing.T) {
+	defer func(saved time.Duration) { mqFlushTimeout = saved }(mqFlushTimeout)
+	mqFlushTimeout = 500 * time.Millisecond
+
+	client := &slowMQ{delay: 200 * time.Millisecond}
+	p := startMQPublisher(client, "runs")
+	for i := 0; i < 20; i++ {
+		p.add(jobConfig{ID: "mq", Command: "echo"}, runResult{Success: true, Output: "1"})
+	}
+
+	started := time.Now()
+	p.flush()
+	if elapsed := time.Since(started); elapsed > 2*mqFlushTimeout {
+		t.Errorf("flushed in %s, want about %s", elapsed, mqFlushTimeout)
+	}
+	if published := atomic.LoadInt32(&client.published); published == 0 || published >= 20 {
+		t.Errorf("got %d records published, want some of them dropped", published)
+	}
+
+	// A queue keeping up publishes all of them
+	client = &slowMQ{}
+	p = startMQPublisher(client, "runs")
+	for i := 0; i < 20; i++ {
+		p.add(jobConfig{ID: "mq", Command: "echo"}, runResult{Success: true, Output: "1"})
+	}
+	p.flush()
+	if published := atomic.LoadInt32(&client.published); published != 20 {
+		t.Errorf("got %d records published, want 20", published)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Exit codes of the successful runs, some commands telling outcomes such as "skipped" with their own
+var successExitCodes = map[int]bool{0: true}
+
+// Parse a comma-separated list of exit codes, such as 0,2
+func parseExitCodes(value string) (map[int]bool, error) {
+	codes := map[int]bool{}
+	for _, field := range strings.Split(value, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || code < 0 || code > 255 {
+			return nil, fmt.Errorf("expected exit codes such as 0,2, got %q", value)
+		}
+		codes[code] = true
+	}
+
+	return codes, nil
+}
+
+// How a successful run with no output (or only whitespace) is reported : raw, null, empty or fail
+var emptyOutput = "raw"
+
+// Report an empty output as configured, for servers with strict output expectations
+func handleEmptyOutput(job jobConfig, result *runResult) {
+	if !result.Success || strings.TrimSpace(result.Output) != "" {
+		return
+	}
+
+	switch emptyOutput {
+	case "null":
+		result.Output = "null"
+	case "empty":
+		result.Output = ""
+	case "fail":
+		runLog(job).Warnf("Empty output for run %s\n", job.ID)
+		result.Success = false
+		result.Output = "null"
+		result.Reason = "empty_output"
+		result.Logs = appendLog(result.Logs, "The command did not output anything")
+	}
+}
+
+// Whether CRLF line endings and UTF-8 byte order marks are removed from the output and logs, kept as is by default
+var normalizeNewlines bool
+
+// Normalize the output or logs of a run when enabled, as written by Windows tools to LF line endings without a BOM
+func normalizeText(text string) string {
+	if !normalizeNewlines {
+		return text
+	}
+
+	text = strings.TrimPrefix(text, "\ufeff")
+	return strings.ReplaceAll(text, "\r\n", "\n")
+}
+
+// Commands whose output must be well-formed JSON
+var jsonOutputCommands = map[string]bool{}
+
+// Whether the output of every command must be well-formed JSON, as the API expects, rather than only of those in
+// jsonOutputCommands
+var requireJSONOutput bool
+
+// Replace an output which does not parse by null, which usually means a half-written output or a stack trace, so the
+// API still gets a well-formed result. The raw output is moved to the logs, and a successful run fails
+func validateOutputJSON(job jobConfig, result *runResult) {
+	if !requireJSONOutput && !jsonOutputCommands[job.Command] || json.Valid([]byte(result.Output)) {
+		return
+	}
+
+	var value interface{}
+	err := json.Unmarshal([]byte(result.Output), &value)
+	runLog(job).Warnf("Invalid JSON output for run %s : %v\n", job.ID, err)
+
+	if result.Success {
+		result.Success = false
+		result.Reason = "invalid_output_json"
+	}
+	result.Logs = appendLog(result.Logs, fmt.Sprintf("Invalid JSON output : %v, the output was :", err))
+	result.Logs = appendLog(result.Logs, strings.TrimRight(result.Output, "\n"))
+	result.Output = "null"
+}
+
+// Output of a failed run, sent as is when it is JSON and as a JSON string otherwise, as the API expects JSON
+func failureOutput(output string) string {
+	if json.Valid([]byte(output)) {
+		return output
+	}
+
+	encoded, err := json.Marshal(output)
+	if err != nil {
+		return "null"
+	}
+	return string(encoded)
+}
+
+// Append a line of the agent's own to a run's logs
+func appendLog(logs string, line string) string {
+	if logs != "" && !strings.HasSuffix(logs, "\n") {
+		logs += "\n"
+	}
+
+	return logs + line + "\n"
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestFailureOutput(t *testing.T) {
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{`{"error": "quota exceeded"}`, `{"error": "quota exceeded"}`},
+		{"[1, 2]\n", "[1, 2]\n"},
+		{"42", "42"},
+		{"disk full\n", `"disk full\n"`},
+		{`say "hi"`, `"say \"hi\""`},
+	}
+	for _, test := range tests {
+		if got := failureOutput(test.output); got != test.want {
+			t.Errorf("failureOutput(%q) = %s, want %s", test.output, got, test.want)
+		}
+	}
+}
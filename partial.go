@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Whether "ZETTO_CHECKPOINT: <data>" markers are delivered as partial results
+var partialResults bool
+
+// Checkpoints waiting to be delivered, past which new ones are dropped
+const partialQueueSize = 64
+
+// What happens to the checkpoints which could not be delivered, when the partial endpoint is unreachable or the
+// connection is broken : "buffer" keeps them locally and retries, "drop" discards them
+var streamDisconnect = "buffer"
+
+// Checkpoints kept while the partial endpoint is unreachable, past which the oldest ones are dropped
+const partialBufferSize = 1024
+
+// Delays between attempts to deliver the buffered checkpoints
+const (
+	partialRetryDelay    = time.Second
+	maxPartialRetryDelay = 30 * time.Second
+)
+
+type jobPartial struct {
+	RunID    string `json:"run_id"`
+	Sequence int    `json:"sequence"`
+	Data     string `json:"data"`
+}
+
+// Delivers the checkpoints of a running job in order, without blocking its execution
+type partialSender struct {
+	job      jobConfig
+	queue    chan jobPartial
+	done     chan struct{}
+	sequence int
+}
+
+func (a *Agent) startPartialSender(job jobConfig) *partialSender {
+	sender := &partialSender{
+		job:   job,
+		queue: make(chan jobPartial, partialQueueSize),
+		done:  make(chan struct{}),
+	}
+
+	go func() {
+		defer close(sender.done)
+
+		var pending []jobPartial
+		retries := newBackoff(partialRetryDelay, maxPartialRetryDelay)
+		var retry <-chan time.Time
+		for {
+			select {
+			case partial, ok := <-sender.queue:
+				if !ok {
+					// Last attempt for the buffered checkpoints, the final result is about to be notified
+					if pending = a.deliverPartials(job, pending); len(pending) > 0 {
+						runLog(job).Warnf("Dropping %d undelivered partial results\n", len(pending))
+					}
+					return
+				}
+				pending = append(pending, partial)
+				if len(pending) > partialBufferSize {
+					runLog(job).Warnf("Too many undelivered partial results, dropping checkpoint %d\n", pending[0].Sequence)
+					pending = pending[1:]
+				}
+				if retry != nil {
+					// Still waiting for the endpoint to come back
+					continue
+				}
+			case <-retry:
+				retry = nil
+			}
+
+			if pending = a.deliverPartials(job, pending); len(pending) == 0 {
+				retries.succeeded()
+				continue
+			}
+			if streamDisconnect == "drop" {
+				runLog(job).Warnf("Dropping %d undelivered partial results\n", len(pending))
+				pending = nil
+				continue
+			}
+			retry = time.After(retries.failed())
+		}
+	}()
+
+	return sender
+}
+
+// Queue a checkpoint, called from the output capture so it must not block
+func (p *partialSender) send(data string) {
+	p.sequence++
+	select {
+	case p.queue <- jobPartial{RunID: p.job.ID, Sequence: p.sequence, Data: data}:
+	default:
+		runLog(p.job).Warnf("Too many pending partial results, dropping checkpoint %d\n", p.sequence)
+	}
+}
+
+// Wait for the queued checkpoints to be delivered, so they reach the API before the final notify
+func (p *partialSender) close() {
+	close(p.queue)
+	<-p.done
+}
+
+// Deliver checkpoints in order, up to the first failure. Returns those which are left to deliver
+func (a *Agent) deliverPartials(job jobConfig, partials []jobPartial) []jobPartial {
+	for i, partial := range partials {
+		if err := a.notifyPartial(partial); err != nil {
+			runLog(job).Errorf("Error delivering partial result : %v\n", err)
+			return partials[i:]
+		}
+	}
+	return nil
+}
+
+// Deliver a partial result of a running job
+func (a *Agent) notifyPartial(partial jobPartial) error {
+	payload, err := json.Marshal(partial)
+	if err != nil {
+		return err
+	}
+
+	req, err := a.newRequest("POST", "partial", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+
+	res, err := a.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Partial error %d", res.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPartialEndpointDisconnect(t *testing.T) {
+	defer func(saved bool) { partialResults = saved }(partialResults)
+	partialResults = true
+
+	useRunner(t, `
+echo 'ZETTO_CHECKPOINT: {"step": 1}' >&3
+sleep 1.5
+echo 'ZETTO_CHECKPOINT: {"step": 2}' >&3
+echo '"done"'
+`)
+	api := newFakeAPI(t)
+	api.addJobs(`{"id": "disconnected", "command": "steps", "timeout": 10}`)
+
+	// The endpoint drops the connection of the first checkpoint, as a restarting server would
+	var calls int32
+	api.handle("/partial", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) > 1 {
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	})
+
+	started := time.Now()
+	api.pollAndRun(t, api.agent())
+	if elapsed := time.Since(started); elapsed > 8*time.Second {
+		t.Errorf("the job took %s", elapsed)
+	}
+
+	notifies := api.notifies(t)
+	if len(notifies) != 1 || !notifies[0].Success || notifies[0].Output != "\"done\"\n" {
+		t.Fatalf("got notifies %+v, want the completed run", notifies)
+	}
+
+	// The dropped checkpoint was retried, and the checkpoints delivered in order before the result
+	delivered := []int{}
+	for _, request := range api.requestsTo("/partial") {
+		var partial jobPartial
+		if err := json.Unmarshal(request.Body, &partial); err != nil {
+			t.Fatal(err)
+		}
+		delivered = append(delivered, partial.Sequence)
+	}
+	if len(delivered) != 3 || delivered[0] != 1 || delivered[1] != 1 || delivered[2] != 2 {
+		t.Errorf("got checkpoint deliveries %v, want 1, its retry, then 2", delivered)
+	}
+}
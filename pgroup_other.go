@@ -0,0 +1,34 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Process groups are not available, only the command itself can be killed
+func withProcessGroup(attr *syscall.SysProcAttr) *syscall.SysProcAttr {
+	return attr
+}
+
+func terminateProcessGroup(pid int) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	return process.Signal(syscall.SIGTERM)
+}
+
+func killProcessGroup(pid int) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return nil
+	}
+	if err := process.Kill(); err != nil && err != os.ErrProcessDone {
+		return err
+	}
+
+	return nil
+}
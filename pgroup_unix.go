@@ -0,0 +1,33 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"syscall"
+)
+
+// Run the command in its own process group, so its descendants can be killed along with it
+func withProcessGroup(attr *syscall.SysProcAttr) *syscall.SysProcAttr {
+	if attr == nil {
+		attr = &syscall.SysProcAttr{}
+	}
+	attr.Setpgid = true
+
+	return attr
+}
+
+// Ask the whole process group of a command to terminate
+func terminateProcessGroup(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGTERM)
+}
+
+// Kill whatever is left of the process group of a command
+func killProcessGroup(pid int) error {
+	err := syscall.Kill(-pid, syscall.SIGKILL)
+	if err == syscall.ESRCH {
+		// Nothing left
+		return nil
+	}
+
+	return err
+}
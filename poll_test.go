@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPollGate(t *testing.T) {
+	defer func(saved chan struct{}) { pollGate = saved }(pollGate)
+	pollGate = make(chan struct{}, 2)
+
+	api := newFakeAPI(t)
+	var inFlight, maxInFlight int32
+	api.handle("/pop", func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for seen := atomic.LoadInt32(&maxInFlight); current > seen; seen = atomic.LoadInt32(&maxInFlight) {
+			atomic.CompareAndSwapInt32(&maxInFlight, seen, current)
+		}
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusNotFound)
+	})
+	agent := api.agent()
+
+	// However many pollers, only two requests at once
+	var pollers sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		pollers.Add(1)
+		go func() {
+			defer pollers.Done()
+			if _, err := agent.poll(`["echo"]`); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	pollers.Wait()
+
+	if got := atomic.LoadInt32(&maxInFlight); got != 2 {
+		t.Errorf("got up to %d polls in flight, want 2", got)
+	}
+	if polls := len(api.requestsTo("/pop")); polls != 6 {
+		t.Errorf("got %d polls, want 6", polls)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Whether the agent checks the API is reachable and accepts its key before starting
+var preflightEnabled bool
+
+// Path of the API called by the preflight check
+var preflightPath = "ping"
+
+// Check the API is reachable and accepts the API key, with a request authenticated as the polls are
+func (a *Agent) preflight() error {
+	req, err := a.newRequest("GET", preflightPath, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := a.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("API unreachable : %v", err)
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("API key rejected (%d)", res.StatusCode)
+	case res.StatusCode >= 500:
+		return fmt.Errorf("API error %d", res.StatusCode)
+	case res.StatusCode >= 300:
+		// Reachable, and the key was not rejected : good enough to go on
+		log.Printf("Preflight got a %d response, proceeding\n", res.StatusCode)
+	}
+
+	return nil
+}
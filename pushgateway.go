@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Prometheus Pushgateway receiving the final metrics on exit, empty when disabled
+var pushgatewayURL string
+
+// Push the metrics to the Pushgateway, grouped by the runner's identity
+func pushMetrics() error {
+	if pushgatewayURL == "" {
+		return nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	body := new(bytes.Buffer)
+	writeMetrics(body)
+
+	endpoint := fmt.Sprintf("%s/metrics/job/zetto-agent/instance/%s", strings.TrimRight(pushgatewayURL, "/"), url.PathEscape(hostname))
+	req, err := http.NewRequest("PUT", endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "text/plain; version=0.0.4")
+	req.Header.Add("User-Agent", userAgent(hostname))
+
+	res, err := newHTTPClient(httpTimeout).Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Pushgateway error %d", res.StatusCode)
+	}
+
+	log.Println("Pushed metrics to", pushgatewayURL)
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Age after which a claimed job still waiting to start is given back to the API, 0 keeps jobs however long they wait
+var queueStaleAfter time.Duration
+
+// Jobs claimed from the API which did not start yet, whether debounced or waiting for a slot
+type localQueue struct {
+	mu   sync.Mutex
+	jobs map[string]time.Time
+}
+
+var queue = &localQueue{
+	jobs: map[string]time.Time{},
+}
+
+// Count a claimed job as queued, from its claim time
+func (q *localQueue) enter(job jobConfig) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.jobs[job.ID] = job.claimedAt
+}
+
+// Remove a job from the queue, once started or given back
+func (q *localQueue) leave(job jobConfig) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.jobs, job.ID)
+}
+
+// Number of queued jobs, and the age of the oldest one
+func (q *localQueue) status(now time.Time) (int, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var oldest time.Duration
+	for _, claimedAt := range q.jobs {
+		if age := now.Sub(claimedAt); age > oldest {
+			oldest = age
+		}
+	}
+
+	return len(q.jobs), oldest
+}
+
+// Whether a queued job waited too long to start, in which case it is nacked so the API can hand it to another runner
+func (a *Agent) nackIfStale(job jobConfig) bool {
+	if queueStaleAfter <= 0 || time.Since(job.claimedAt) <= queueStaleAfter {
+		return false
+	}
+
+	runLog(job).Warnf("Job %s queued for too long, giving it back\n", job.ID)
+	queue.leave(job)
+	if err := a.nack(job, "stale"); err != nil {
+		runLog(job).Errorf("Error nacking job : %v\n", err)
+	}
+
+	return true
+}
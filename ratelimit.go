@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Most jobs started per minute, whatever the number of queued jobs, 0 for no limit
+var maxJobsPerMinute int
+
+// Spaces job starts evenly at the configured rate : a token bucket holding a single token, refilled every interval
+type jobRateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// Limiter of the job starts, nil without a limit
+var jobRate *jobRateLimiter
+
+func newJobRateLimiter(perMinute int) *jobRateLimiter {
+	return &jobRateLimiter{
+		interval: time.Minute / time.Duration(perMinute),
+	}
+}
+
+// Wait until a job may start, without taking its turn : the main loop only claims a job it can start right away
+func (l *jobRateLimiter) waitReady() {
+	l.mu.Lock()
+	delay := time.Until(l.next)
+	l.mu.Unlock()
+
+	if delay > 0 {
+		sleepUnlessShutdown(delay)
+	}
+}
+
+// Take the turn of a job start, waiting for it if needed
+func (l *jobRateLimiter) wait() {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if delay > 0 {
+		sleepUnlessShutdown(delay)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Patterns whose matches are masked in every log line, such as credentials echoed by the commands
+var redactPatterns []*regexp.Regexp
+
+// Value of an Authorization header, as logged in a text, JSON or Go representation of the headers
+var authorizationValue = regexp.MustCompile(`(?i)(authorization"?\s*[:=]\s*\[?"?)[^"\]\r\n]+`)
+
+// Parse regular expressions separated by commas. A comma within an expression is escaped as \,
+func parseRedactPatterns(spec string) ([]*regexp.Regexp, error) {
+	patterns := []*regexp.Regexp{}
+	for _, expr := range splitUnescaped(spec, ',') {
+		if expr = strings.TrimSpace(expr); expr == "" {
+			continue
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern %q : %v", expr, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns, nil
+}
+
+// Split on the separators not preceded by a backslash, unescaping the others
+func splitUnescaped(s string, sep byte) []string {
+	parts := []string{}
+	var part strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == sep:
+			part.WriteByte(sep)
+			i++
+		case s[i] == sep:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(s[i])
+		}
+	}
+
+	return append(parts, part.String())
+}
+
+// Mask the secrets of a log line : those of the agent, the Authorization headers, and the matches of the redact
+// patterns. Only what is logged is masked, never what is sent to the API
+func redactLog(msg string) string {
+	if logs != nil {
+		msg = logs.redact(msg)
+	}
+
+	msg = authorizationValue.ReplaceAllString(msg, "${1}***")
+	for _, pattern := range redactPatterns {
+		msg = pattern.ReplaceAllString(msg, "***")
+	}
+	return msg
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Returned by notify when the API rejects a run for a command it does not know the runner supports
+var errUnknownCommand = errors.New("Command rejected as unknown")
+
+// Maximum random delay before refreshing the command list after a drift, so runners do not all relist at once
+var relistJitter = 5 * time.Second
+
+var relistMu sync.Mutex
+
+// Time at which the command list should be refreshed, zero when no refresh is due
+var relistAt time.Time
+
+// Interval between periodic refreshes of the command list, so commands added to or removed from the runner are picked
+// up while the agent runs. 0 disables them
+var relistInterval = 5 * time.Minute
+
+// Time of the last refresh of the command list
+var listedAt time.Time
+
+// Schedule a command list refresh after the API rejected an advertised command
+func requestRelist(command string) {
+	relistMu.Lock()
+	defer relistMu.Unlock()
+
+	if !relistAt.IsZero() {
+		return
+	}
+
+	var delay time.Duration
+	if relistJitter > 0 {
+		delay = time.Duration(rand.Int63n(int64(relistJitter)))
+	}
+	agentLog.Warnf("Command %s was rejected as unknown though it was advertised, the runner's commands may have drifted. Refreshing the command list in %s\n", command, delay)
+	relistAt = time.Now().Add(delay)
+}
+
+// Whether a command list refresh is due, either scheduled after a drift or periodic, in which case it is cleared
+func relistDue() bool {
+	relistMu.Lock()
+	defer relistMu.Unlock()
+
+	now := time.Now()
+	if listedAt.IsZero() {
+		// The list was fetched at startup
+		listedAt = now
+	}
+	drifted := !relistAt.IsZero() && !now.Before(relistAt)
+	periodic := relistInterval > 0 && now.Sub(listedAt) >= relistInterval
+	if !drifted && !periodic {
+		return false
+	}
+
+	relistAt = time.Time{}
+	listedAt = now
+	return true
+}
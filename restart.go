@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Whether SIGUSR2 re-executes the agent's binary, handing its listeners over to the new process
+var gracefulRestart bool
+
+// Names of the listeners inherited from the process which re-executed the agent, in the order of their descriptors
+const listenFDsEnv = "ZETTO_LISTEN_FDS"
+
+// Set in the environment of a re-executed agent
+const parentPIDEnv = "ZETTO_PARENT_PID"
+
+// Descriptor on which a re-executed agent tells the previous process it took over the listeners
+const readyFDEnv = "ZETTO_READY_FD"
+
+// First descriptor of the inherited listeners, after STDIN, STDOUT and STDERR
+const firstListenFD = 3
+
+// Time given to a re-executed agent to take over the listeners, past which it is killed and the restart given up
+var restartReadyTimeout = 30 * time.Second
+
+var (
+	listenersMu sync.Mutex
+	listeners   = map[string]net.Listener{}
+)
+
+// Handover from the process which re-executed the agent, taken from the environment at startup
+var (
+	inheritedNames []string
+	parentPID      int
+	readyFD        = -1
+)
+
+// Take the handover from the environment, clearing it so the jobs do not inherit it
+func takeRestartEnv() {
+	if names := os.Getenv(listenFDsEnv); names != "" {
+		inheritedNames = strings.Split(names, ",")
+	}
+	parentPID, _ = strconv.Atoi(os.Getenv(parentPIDEnv))
+	if fd, err := strconv.Atoi(os.Getenv(readyFDEnv)); err == nil {
+		readyFD = fd
+	}
+
+	for _, name := range []string{listenFDsEnv, parentPIDEnv, readyFDEnv} {
+		os.Unsetenv(name)
+	}
+}
+
+// Whether the agent was started by the graceful restart of a previous one
+func reexecuted() bool {
+	return parentPID != 0
+}
+
+// Whether the process which re-executed the agent still runs, finishing and delivering its own jobs
+func parentRunning() bool {
+	return parentPID != 0 && os.Getppid() == parentPID
+}
+
+// Listen on an address, or take over the listener of the same name inherited from the previous process. Returns
+// whether it was inherited
+func listen(name string, network string, address string) (net.Listener, bool, error) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	inherited, err := inheritedListener(name)
+	if err != nil {
+		return nil, false, err
+	}
+	if inherited != nil {
+		listeners[name] = inherited
+		return inherited, true, nil
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, false, err
+	}
+	listeners[name] = listener
+	return listener, false, nil
+}
+
+// Listener of the given name inherited from the previous process, nil if there is none
+func inheritedListener(name string) (net.Listener, error) {
+	for i, inherited := range inheritedNames {
+		if inherited != name {
+			continue
+		}
+		file := os.NewFile(uintptr(firstListenFD+i), name)
+		if file == nil {
+			return nil, fmt.Errorf("Inherited listener %s is not open", name)
+		}
+		defer file.Close()
+		return net.FileListener(file)
+	}
+
+	return nil, nil
+}
+
+// Descriptors of the listeners to hand over to a new process, with their names
+func listenerFiles() ([]string, []*os.File, error) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	names := make([]string, 0, len(listeners))
+	for name := range listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := make([]*os.File, 0, len(names))
+	for _, name := range names {
+		var file *os.File
+		var err error
+		switch listener := listeners[name].(type) {
+		case *net.TCPListener:
+			file, err = listener.File()
+		case *net.UnixListener:
+			// The socket is now the new process', closing it here must not remove it
+			listener.SetUnlinkOnClose(false)
+			file, err = listener.File()
+		default:
+			err = fmt.Errorf("Listener %s can not be handed over", name)
+		}
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, nil, err
+		}
+		files = append(files, file)
+	}
+
+	return names, files, nil
+}
+
+// Stop accepting on the listeners once a new process took them over
+func closeListeners() {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	for name, listener := range listeners {
+		if err := listener.Close(); err != nil {
+			agentLog.Warnf("Could not close listener %s : %v\n", name, err)
+		}
+	}
+	listeners = map[string]net.Listener{}
+}
+
+// Tell the process which re-executed the agent that the listeners were taken over, so it stops accepting on them
+func signalRestartReady() {
+	fd := readyFD
+	if fd < 0 {
+		return
+	}
+	readyFD = -1
+
+	file := os.NewFile(uintptr(fd), "ready")
+	if file == nil {
+		agentLog.Warnf("Could not tell the previous process the listeners were taken over : descriptor %d is not open\n", fd)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write([]byte{1}); err != nil {
+		agentLog.Warnf("Could not tell the previous process the listeners were taken over : %v\n", err)
+	}
+}
+
+// Environment of the new process, with the names of the listeners it inherits and the descriptor telling it took them
+// over
+func restartEnv(names []string, readyFD int) []string {
+	return append(os.Environ(),
+		fmt.Sprintf("%s=%s", listenFDsEnv, strings.Join(names, ",")),
+		fmt.Sprintf("%s=%d", parentPIDEnv, os.Getpid()),
+		fmt.Sprintf("%s=%d", readyFDEnv, readyFD),
+	)
+}
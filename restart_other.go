@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package main
+
+// There is no SIGUSR2 on this platform
+func handleRestarts() {
+	if gracefulRestart {
+		agentLog.Warnf("Graceful restarts are not supported on this platform\n")
+	}
+}
@@ -0,0 +1,111 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Restart gracefully on SIGUSR2 : a new process of the agent's binary, possibly updated, takes over the listeners and
+// starts claiming jobs, while this one stops accepting and claiming, and exits once its running jobs are done and
+// notified
+func handleRestarts() {
+	if !gracefulRestart {
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+
+	go func() {
+		for range signals {
+			if shuttingDown() {
+				continue
+			}
+
+			log.Println("Received SIGUSR2, restarting")
+			pid, err := reexec()
+			if err != nil {
+				agentLog.Errorf("Could not restart : %v, going on\n", err)
+				continue
+			}
+
+			// Each job is only claimed by one of the processes, this one keeps running and notifying its own
+			log.Printf("Restarted as process %d, exiting once the running jobs are done\n", pid)
+			closeListeners()
+			requestShutdown()
+			return
+		}
+	}()
+}
+
+// Start a new process of the agent's binary, inheriting the listeners, and wait for it to take them over
+func reexec() (int, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	names, files, err := listenerFiles()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	// Passed after the listeners, the new process writes on it once it took them over
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer readyReader.Close()
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = restartEnv(names, firstListenFD+len(files))
+	cmd.ExtraFiles = append(files, readyWriter)
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	// The pipe ends without a write if the new process exits first
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyReader.Read(make([]byte, 1))
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(restartReadyTimeout):
+		err = fmt.Errorf("not ready after %s", restartReadyTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if errors.Is(err, io.EOF) {
+			err = errors.New("the new process exited before taking over the listeners")
+		}
+		return 0, err
+	}
+
+	// Not waited for, it outlives this process
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+	return pid, nil
+}
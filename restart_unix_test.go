@@ -0,0 +1,47 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestRestartHandover(t *testing.T) {
+	defer func(saved map[string]net.Listener) { listeners = saved }(listeners)
+	listeners = map[string]net.Listener{}
+
+	listener, inherited, err := listen("health", "tcp", "127.0.0.1:0")
+	if err != nil || inherited {
+		t.Fatalf("got inherited %v, error %v", inherited, err)
+	}
+
+	// The new process tells it took the listeners over
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	// Its own descriptor, which signalRestartReady closes
+	fd, err := syscall.Dup(int(writer.Fd()))
+	writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readyFD = fd
+	signalRestartReady()
+	if n, err := reader.Read(make([]byte, 1)); n != 1 || err != nil {
+		t.Fatalf("got %d bytes and %v from the ready pipe", n, err)
+	}
+
+	// Then the previous one stops accepting
+	closeListeners()
+	if _, err := listener.Accept(); err == nil {
+		t.Error("the listener still accepts once handed over")
+	}
+	if len(listeners) != 0 {
+		t.Errorf("got %d listeners left", len(listeners))
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type cachedResult struct {
+	result  runResult
+	expires time.Time
+}
+
+// Recently computed results by run ID, so a job re-sent by the API is notified again without re-running it
+type resultCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]cachedResult
+
+	// Run IDs in insertion order, the oldest being evicted first once the cache is full
+	order []string
+}
+
+// Cache enabled by ZETTO_RESULT_CACHE_TTL, nil when disabled
+var results *resultCache
+
+func newResultCache(ttl time.Duration, maxEntries int) *resultCache {
+	return &resultCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]cachedResult{},
+	}
+}
+
+func (c *resultCache) get(runID string) (runResult, bool) {
+	if c == nil {
+		return runResult{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[runID]
+	if !ok || time.Now().After(entry.expires) {
+		return runResult{}, false
+	}
+
+	return entry.result, true
+}
+
+func (c *resultCache) put(runID string, result runResult) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[runID]; !ok {
+		c.order = append(c.order, runID)
+	}
+	c.entries[runID] = cachedResult{
+		result:  result,
+		expires: time.Now().Add(c.ttl),
+	}
+
+	// Drop expired entries, then the oldest ones while over the size bound
+	now := time.Now()
+	for len(c.order) > 0 {
+		oldest := c.order[0]
+		if len(c.order) <= c.maxEntries && now.Before(c.entries[oldest].expires) {
+			break
+		}
+		delete(c.entries, oldest)
+		c.order = c.order[1:]
+	}
+}
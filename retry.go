@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeout of a job which does not set one, in seconds, when neither its command nor ZETTO_DEFAULT_TIMEOUT give one
+const defaultJobTimeout = 15
+
+// Timeout of the jobs which do not set one and whose command has no default timeout, 0 for defaultJobTimeout
+var defaultTimeout time.Duration
+
+var (
+	commandTimeoutsMu sync.Mutex
+
+	// Default timeouts of some commands, in seconds, as advertised by the command list
+	commandTimeouts = map[string]int{}
+)
+
+// Record the default timeouts of a freshly listed set of commands
+func refreshCommandTimeouts(commands string) {
+	list, err := parseCommandsList(commands)
+	if err != nil {
+		return
+	}
+
+	timeouts := map[string]int{}
+	for _, command := range list {
+		if command.Timeout > 0 {
+			timeouts[command.Name] = command.Timeout
+		}
+	}
+
+	commandTimeoutsMu.Lock()
+	defer commandTimeoutsMu.Unlock()
+	commandTimeouts = timeouts
+}
+
+// Timeout of a job in seconds, capped to ZETTO_MAX_TIMEOUT so a single job can not hold a runner for too long
+func jobTimeout(job jobConfig) int {
+	timeout := requestedTimeout(job)
+	if max := int(maxTimeout.Seconds()); max > 0 && timeout > max {
+		runLog(job).Warnf("Timeout of run %s (%ds) is over the max, clamping to %s\n", job.ID, timeout, maxTimeout)
+		return max
+	}
+
+	return timeout
+}
+
+// Timeout of a job in seconds : its own if positive, else the default of its command, else ZETTO_DEFAULT_TIMEOUT, else
+// defaultJobTimeout
+func requestedTimeout(job jobConfig) int {
+	if job.Timeout > 0 {
+		return job.Timeout
+	}
+
+	commandTimeoutsMu.Lock()
+	timeout, ok := commandTimeouts[job.Command]
+	commandTimeoutsMu.Unlock()
+	if ok {
+		return timeout
+	}
+
+	if defaultTimeout > 0 {
+		return int(math.Ceil(defaultTimeout.Seconds()))
+	}
+	return defaultJobTimeout
+}
+
+// Retries of a failed execution, 0 to report the first failure
+var execRetries int
+
+// Factor applied to the timeout of each retry, since a failure may come from a slow rather than broken job
+var retryTimeoutMultiplier = 1.0
+
+// Multipliers overriding retryTimeoutMultiplier for some commands
+var retryTimeoutMultipliers = map[string]float64{}
+
+// Parse per-command multipliers such as "build:2,deploy:1.5"
+func parseTimeoutMultipliers(spec string) (map[string]float64, error) {
+	return parseCommandValues(spec, func(value float64) bool { return value >= 1 })
+}
+
+// Parse per-command values such as "build:2,deploy:1.5", each value being checked by valid
+func parseCommandValues(spec string, valid func(float64) bool) (map[string]float64, error) {
+	values := map[string]float64{}
+	if strings.TrimSpace(spec) == "" {
+		return values, nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid entry %q", entry)
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || !valid(value) {
+			return nil, fmt.Errorf("Invalid entry %q", entry)
+		}
+		values[strings.TrimSpace(parts[0])] = value
+	}
+
+	return values, nil
+}
+
+// Timeout of an attempt in seconds, base * multiplier^attempt, capped to ZETTO_MAX_TIMEOUT when there is one
+func attemptTimeout(base int, multiplier float64, attempt int) int {
+	timeout := float64(base) * math.Pow(multiplier, float64(attempt))
+	if maxTimeout > 0 {
+		timeout = math.Min(timeout, maxTimeout.Seconds())
+	}
+	return int(math.Ceil(timeout))
+}
+
+// Execute a job, retrying failures with timeouts growing as timeout * multiplier^attempt, capped to ZETTO_MAX_TIMEOUT.
+// Failures before the command ran are not retried, unless resources lacked to start it
+func (a *Agent) execWithRetries(ctx context.Context, job jobConfig) runResult {
+	base := jobTimeout(job)
+
+	multiplier := retryTimeoutMultiplier
+	if perCommand, ok := retryTimeoutMultipliers[job.Command]; ok {
+		multiplier = perCommand
+	}
+
+	timeouts := []int{}
+	var queueWait time.Duration
+	for attempt := 0; ; attempt++ {
+		attemptJob := job
+		attemptJob.Timeout = attemptTimeout(base, multiplier, attempt)
+		timeouts = append(timeouts, attemptJob.Timeout)
+
+		if attempt > 0 {
+			runLog(job).Printf("Retrying run %s (attempt %d) with a timeout of %ds\n", job.ID, attempt+1, attemptJob.Timeout)
+		}
+
+		// The queue wait is the one before the first attempt
+		result := a.execJob(ctx, attemptJob)
+		if attempt == 0 {
+			queueWait = result.QueueWait
+		}
+		result.QueueWait = queueWait
+
+		// A job failing before its command ran, such as a missing runner or a rejected command, fails the same way
+		// again. Only a lack of resources may clear up
+		retryable := result.ExitCode != nil || result.StartResourcesLacked
+		if result.Success || result.Cancelled || !retryable || attempt >= execRetries || ctx.Err() != nil {
+			result.AttemptTimeouts = timeouts
+			return result
+		}
+	}
+}
+
+// Retries of a failed notify, with delays doubling from notifyRetryDelay up to notifyRetryMaxDelay
+var (
+	notifyRetries       = 5
+	notifyRetryDelay    = time.Second
+	notifyRetryMaxDelay = time.Minute
+)
+
+// Whether a notify failure may succeed later : connection errors, timeouts, 429 and 5xx responses.
+// Other 4xx responses mean the API rejected the result
+func isTransientNotifyError(err error) bool {
+	if classifyError(err) == errorClient {
+		return false
+	}
+
+	return !errors.Is(err, errAlreadyCompleted) && !errors.Is(err, errUnknownCommand)
+}
+
+// Notify a run's result to the API at baseURL, retrying transient failures with an exponential backoff until the
+// context is done
+func (a *Agent) notifyWithRetries(ctx context.Context, baseURL string, job jobConfig, result runResult) error {
+	delays := newBackoff(notifyRetryDelay, notifyRetryMaxDelay)
+	for attempt := 0; ; attempt++ {
+		err := a.notify(ctx, baseURL, job, result)
+		if err == nil || !isTransientNotifyError(err) || attempt >= notifyRetries || ctx.Err() != nil {
+			return err
+		}
+
+		delay := delays.failed()
+		runLog(job).Errorf("Error notifying run %s : %v, retrying in %s\n", job.ID, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAttemptTimeout(t *testing.T) {
+	defer func(saved time.Duration) { maxTimeout = saved }(maxTimeout)
+
+	tests := []struct {
+		max        time.Duration
+		base       int
+		multiplier float64
+		attempt    int
+		want       int
+	}{
+		{time.Hour, 10, 2, 0, 10},
+		{time.Hour, 10, 2, 1, 20},
+		{time.Hour, 10, 2, 3, 80},
+		{time.Hour, 10, 1.5, 1, 15},
+		{time.Hour, 10, 1.25, 1, 13},
+		{time.Hour, 10, 1, 4, 10},
+		{time.Minute, 10, 2, 2, 40},
+		{time.Minute, 10, 2, 3, 60},
+		{time.Minute, 10, 2, 10, 60},
+		{90 * time.Second, 60, 2, 1, 90},
+		{0, 10, 2, 0, 10},
+		{0, 10, 2, 3, 80},
+		{0, 3600, 3, 2, 32400},
+	}
+	for _, test := range tests {
+		maxTimeout = test.max
+		if got := attemptTimeout(test.base, test.multiplier, test.attempt); got != test.want {
+			t.Errorf("attemptTimeout(%d, %g, %d) with a max of %s = %d, want %d", test.base, test.multiplier, test.attempt, test.max, got, test.want)
+		}
+	}
+}
+
+func TestJobTimeout(t *testing.T) {
+	defer func(max, fallback time.Duration, saved map[string]int) {
+		maxTimeout, defaultTimeout, commandTimeouts = max, fallback, saved
+	}(maxTimeout, defaultTimeout, commandTimeouts)
+	commandTimeouts = map[string]int{"build": 600}
+
+	tests := []struct {
+		name     string
+		max      time.Duration
+		fallback time.Duration
+		job      jobConfig
+		want     int
+	}{
+		{"zero", time.Hour, 0, jobConfig{Timeout: 0}, defaultJobTimeout},
+		{"negative", time.Hour, 0, jobConfig{Timeout: -30}, defaultJobTimeout},
+		{"negative with a default", time.Hour, 20 * time.Second, jobConfig{Timeout: -30}, 20},
+		{"negative with a command default", time.Hour, 20 * time.Second, jobConfig{Command: "build", Timeout: -30}, 600},
+		{"normal", time.Hour, 0, jobConfig{Timeout: 300}, 300},
+		{"over the max", time.Hour, 0, jobConfig{Timeout: 86400}, 3600},
+		{"no max", 0, 0, jobConfig{Timeout: 86400}, 86400},
+		{"default over the max", time.Minute, 0, jobConfig{Command: "build"}, 60},
+	}
+	for _, test := range tests {
+		maxTimeout, defaultTimeout = test.max, test.fallback
+		if got := jobTimeout(test.job); got != test.want {
+			t.Errorf("%s : got a timeout of %ds, want %ds", test.name, got, test.want)
+		}
+	}
+}
+
+// The deadline set for the command follows the clamped timeout
+func TestExecJobDeadline(t *testing.T) {
+	defer func(max, fallback, grace time.Duration, retries int) {
+		maxTimeout, defaultTimeout, killGrace, execRetries = max, fallback, grace, retries
+	}(maxTimeout, defaultTimeout, killGrace, execRetries)
+	maxTimeout, defaultTimeout, killGrace, execRetries = 2*time.Second, time.Second, 500*time.Millisecond, 0
+
+	useRunner(t, "sleep 30\n")
+	agent := &Agent{}
+
+	tests := []struct {
+		name    string
+		timeout int
+		want    time.Duration
+	}{
+		{"zero", 0, time.Second},
+		{"negative", -5, time.Second},
+		{"normal", 1, time.Second},
+		{"over the max", 86400, 2 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := agent.execWithRetries(context.Background(), jobConfig{ID: "deadline", Command: "sleep", Timeout: test.timeout})
+			if !result.TimedOut {
+				t.Errorf("got timed out %v, want the run to time out", result.TimedOut)
+			}
+			if result.Duration < test.want || result.Duration > test.want+time.Second {
+				t.Errorf("got a duration of %s, want about %s", result.Duration, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Command printing the source revision of the runner commands, refreshed along with the command list. Empty when not used
+var revisionCommand []string
+
+const revisionTimeout = 10 * time.Second
+
+var (
+	revisionMu      sync.Mutex
+	commandRevision string
+)
+
+// Fetch the revision of the runner commands, from ZETTO_COMMAND_REVISION_COMMAND or else ZETTO_COMMAND_REVISION.
+// A revision which can not be found is unknown, which does not prevent running jobs
+func refreshRevision() {
+	revision := os.Getenv("ZETTO_COMMAND_REVISION")
+	if len(revisionCommand) > 0 {
+		revision = "unknown"
+
+		ctx, cancel := context.WithTimeout(context.Background(), revisionTimeout)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, revisionCommand[0], revisionCommand[1:]...).Output()
+		if err != nil {
+			agentLog.Errorf("Error fetching the command revision : %v\n", err)
+		} else if trimmed := strings.TrimSpace(string(out)); trimmed != "" {
+			revision = trimmed
+		}
+	}
+
+	revisionMu.Lock()
+	defer revisionMu.Unlock()
+	commandRevision = revision
+}
+
+// Revision of the runner commands, empty when not configured
+func currentRevision() string {
+	revisionMu.Lock()
+	defer revisionMu.Unlock()
+
+	return commandRevision
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Interval between polls of a running job's control endpoint, for the directives of the API such as a cancellation.
+// 0 disables them
+var runControlInterval time.Duration
+
+// Directive of the API for a running job, such as {"action":"cancel"}
+type runControl struct {
+	Action string `json:"action"`
+}
+
+// Poll the control endpoint of a running job until the returned function is called. The job is cancelled when the
+// API answers with a cancel action
+func (a *Agent) watchRunControl(job jobConfig, cancel context.CancelFunc) func() {
+	if runControlInterval <= 0 {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(runControlInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				action, err := a.runControlAction(job)
+				if err != nil {
+					runLog(job).Errorf("Error polling the run control : %v\n", err)
+					continue
+				}
+				if action == "cancel" {
+					runLog(job).Printf("Run %s cancelled by the API\n", job.ID)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+	}
+}
+
+// Fetch the pending directive of a running job, empty when there is none
+func (a *Agent) runControlAction(job jobConfig) (string, error) {
+	req, err := a.newRequest("GET", fmt.Sprintf("runs/%s/control", url.PathEscape(job.ID)), nil)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := a.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	// No directive
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusNoContent {
+		return "", nil
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return "", statusError{"Run control", res.StatusCode}
+	}
+
+	var control runControl
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	if len(bytes.TrimSpace(body)) == 0 {
+		return "", nil
+	}
+	if err := json.Unmarshal(body, &control); err != nil {
+		return "", fmt.Errorf("Malformed run control : %w", err)
+	}
+
+	return control.Action, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRunControlCancel(t *testing.T) {
+	defer func(interval, grace time.Duration) {
+		runControlInterval, killGrace = interval, grace
+	}(runControlInterval, killGrace)
+	runControlInterval = 100 * time.Millisecond
+	killGrace = 500 * time.Millisecond
+
+	useRunner(t, `
+case $1 in
+  sleep) sleep 30;;
+  stubborn) trap "" TERM; sleep 30;;
+esac
+`)
+
+	tests := []struct {
+		command string
+		signal  string
+	}{
+		{"sleep", "SIGTERM"},
+		{"stubborn", "SIGKILL"},
+	}
+	for _, test := range tests {
+		t.Run(test.command, func(t *testing.T) {
+			api := newFakeAPI(t)
+			api.addJobs(`{"id": "cancel-` + test.command + `", "command": "` + test.command + `", "timeout": 20}`)
+			time.AfterFunc(300*time.Millisecond, func() { api.cancel("cancel-" + test.command) })
+
+			started := time.Now()
+			api.pollAndRun(t, api.agent())
+			if elapsed := time.Since(started); elapsed > 5*time.Second {
+				t.Errorf("cancelled after %s", elapsed)
+			}
+
+			notifies := api.notifies(t)
+			if len(notifies) != 1 {
+				t.Fatalf("got %d notifies, want 1", len(notifies))
+			}
+			notify := notifies[0]
+			if notify.Success || !notify.Cancelled || notify.Reason != "cancelled" || notify.Signal != test.signal {
+				t.Errorf("got success %v, cancelled %v, reason %q, signal %q", notify.Success, notify.Cancelled, notify.Reason, notify.Signal)
+			}
+
+			acks := api.requestsTo("/cancel-ack")
+			if len(acks) != 1 {
+				t.Fatalf("got %d cancel acks, want 1", len(acks))
+			}
+			var ack jobCancelAck
+			if err := json.Unmarshal(acks[0].Body, &ack); err != nil || ack.RunID != "cancel-"+test.command {
+				t.Errorf("got cancel ack %s", acks[0].Body)
+			}
+		})
+	}
+}
+
+// A cancellation arriving along with the timeout stops the command once, and reports one of them
+func TestRunControlCancelAtTimeout(t *testing.T) {
+	defer func(interval, grace time.Duration) {
+		runControlInterval, killGrace = interval, grace
+	}(runControlInterval, killGrace)
+	runControlInterval = 50 * time.Millisecond
+	killGrace = 500 * time.Millisecond
+
+	useRunner(t, `trap "" TERM; sleep 30`+"\n")
+	api := newFakeAPI(t)
+	api.addJobs(`{"id": "race", "command": "stubborn", "timeout": 1}`)
+	time.AfterFunc(950*time.Millisecond, func() { api.cancel("race") })
+
+	api.pollAndRun(t, api.agent())
+
+	notifies := api.notifies(t)
+	if len(notifies) != 1 {
+		t.Fatalf("got %d notifies, want 1", len(notifies))
+	}
+	if notify := notifies[0]; notify.Success || notify.Cancelled == notify.TimedOut {
+		t.Errorf("got cancelled %v and timed out %v, want either", notify.Cancelled, notify.TimedOut)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A set of identical runner invocations serving the same command, between which jobs are spread
+type runnerSet struct {
+	mu       sync.Mutex
+	runners  [][]string
+	inFlight []int
+	next     int
+}
+
+// Runner sets per command, parsed from ZETTO_COMMAND_RUNNERS
+var commandRunners = map[string]*runnerSet{}
+
+// Strategy used to pick a runner in a set : "round-robin" or "least-loaded"
+var runnerSelection = "round-robin"
+
+// Parse a runners list such as "build:/usr/bin/node a.js|/usr/bin/node b.js,deploy:/usr/bin/deploy"
+func parseCommandRunners(spec string) (map[string]*runnerSet, error) {
+	sets := map[string]*runnerSet{}
+	if strings.TrimSpace(spec) == "" {
+		return sets, nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(entry, ":", 2)
+		command := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || command == "" {
+			return nil, fmt.Errorf("Invalid command runners entry %q", entry)
+		}
+
+		set := &runnerSet{}
+		for _, runner := range strings.Split(parts[1], "|") {
+			args := strings.Fields(runner)
+			if len(args) == 0 {
+				return nil, fmt.Errorf("Empty runner for command %q", command)
+			}
+			set.runners = append(set.runners, args)
+		}
+		set.inFlight = make([]int, len(set.runners))
+		sets[command] = set
+	}
+
+	return sets, nil
+}
+
+// Pick the next runner of the set, and mark it as in use until the returned release function is called
+func (s *runnerSet) acquire() ([]string, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := s.next
+	if runnerSelection == "least-loaded" {
+		// Lowest in-flight count wins, ties are broken in round-robin order
+		for i := range s.runners {
+			candidate := (s.next + i) % len(s.runners)
+			if s.inFlight[candidate] < s.inFlight[index] {
+				index = candidate
+			}
+		}
+	}
+	s.next = (index + 1) % len(s.runners)
+	s.inFlight[index]++
+
+	release := func() {
+		s.mu.Lock()
+		s.inFlight[index]--
+		s.mu.Unlock()
+	}
+
+	// Copy the arguments so the caller can append to them freely
+	return append([]string{}, s.runners[index]...), release
+}
+
+// Runners per job type, parsed from ZETTO_RUNNERS
+var typeRunners = map[string][]string{}
+
+// Parse a type runners list such as "python:/usr/bin/py-runner,node:/usr/bin/node runner.js"
+func parseTypeRunners(spec string) (map[string][]string, error) {
+	runners := map[string][]string{}
+	if strings.TrimSpace(spec) == "" {
+		return runners, nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(entry, ":", 2)
+		jobType := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || jobType == "" {
+			return nil, fmt.Errorf("Invalid runners entry %q", entry)
+		}
+
+		args := strings.Fields(parts[1])
+		if len(args) == 0 {
+			return nil, fmt.Errorf("Empty runner for type %q", jobType)
+		}
+		runners[jobType] = args
+	}
+
+	return runners, nil
+}
+
+// Resolve the runner invocation for a job : the runner of its type if it has one, else of its command, falling back
+// to ZETTO_RUNNER. A type without a runner is an error, rather than running the job with another runner
+func resolveRunner(job jobConfig) ([]string, func(), error) {
+	if job.Type != "" {
+		runner, ok := typeRunners[job.Type]
+		if !ok {
+			return nil, nil, fmt.Errorf("No runner configured for job type %q", job.Type)
+		}
+		return append([]string{}, runner...), func() {}, nil
+	}
+
+	if set, ok := commandRunners[job.Command]; ok {
+		runner, release := set.acquire()
+		return runner, release, nil
+	}
+
+	return strings.Split(os.Getenv("ZETTO_RUNNER"), " "), func() {}, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Command resolving secret references, called as $ZETTO_SECRET_RESOLVER <name>. Empty when disabled
+var secretResolver []string
+
+var secretResolverTimeout = 10 * time.Second
+
+// References to secrets in a job input, such as "secret://db-password"
+var secretReference = regexp.MustCompile(`secret://[A-Za-z0-9._/-]+`)
+
+// Expand the secret references of a job input. The resolved input and secrets must never be logged
+func resolveSecrets(input string) (string, error) {
+	if len(secretResolver) == 0 || !strings.Contains(input, "secret://") {
+		return input, nil
+	}
+
+	resolved := map[string]string{}
+	var resolveErr error
+	expanded := secretReference.ReplaceAllStringFunc(input, func(reference string) string {
+		name := strings.TrimPrefix(reference, "secret://")
+		if value, ok := resolved[name]; ok {
+			return value
+		}
+		if resolveErr != nil {
+			return reference
+		}
+
+		secret, err := resolveSecret(name)
+		if err != nil {
+			resolveErr = err
+			return reference
+		}
+
+		// References sit inside JSON strings, escape the secret accordingly
+		escaped, _ := json.Marshal(secret)
+		value := string(escaped[1 : len(escaped)-1])
+		resolved[name] = value
+		return value
+	})
+
+	if resolveErr != nil {
+		return "", resolveErr
+	}
+
+	return expanded, nil
+}
+
+// Run the resolver for a single secret. Its output is the secret, and is kept out of errors
+func resolveSecret(name string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), secretResolverTimeout)
+	defer cancel()
+
+	args := append(append([]string{}, secretResolver[1:]...), name)
+	out, err := exec.CommandContext(ctx, secretResolver[0], args...).Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("Could not resolve secret %s : resolver timed out after %s", name, secretResolverTimeout)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Could not resolve secret %s : %v", name, err)
+	}
+
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
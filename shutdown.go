@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// How long the agent keeps running after a first signal, without claiming new jobs, before exiting. 0 exits as soon as the running jobs are done
+var lameDuckDuration time.Duration
+
+// Wall-clock time after which the agent stops claiming jobs and exits once the running ones are done, 0 for no limit
+var maxRuntime time.Duration
+
+var (
+	// Cancelled on the first SIGINT or SIGTERM : the agent stops claiming jobs, and reports not ready
+	shutdownCtx, requestShutdown = context.WithCancel(context.Background())
+
+	// Context of the running jobs, cancelled on a second signal or at the end of the lame-duck period, which kills them
+	jobsCtx, killJobs = context.WithCancel(context.Background())
+
+	// Closed once the lame-duck period is over, right away when there is none
+	lameDuckOver = make(chan struct{})
+)
+
+// Exit code of the agent once shut down
+var shutdownCode int32
+
+// Set to 1 when the shutdown was requested by a signal, rather than caused by an error
+var signalled int32
+
+// Shut down after an error, letting the running jobs finish and notify first
+func shutdownWithError(code int) {
+	atomic.StoreInt32(&shutdownCode, int32(code))
+	requestShutdown()
+}
+
+func shuttingDown() bool {
+	return shutdownCtx.Err() != nil
+}
+
+// Sleep for the given duration, returning early when the agent starts shutting down
+func sleepUnlessShutdown(duration time.Duration) {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-shutdownCtx.Done():
+	}
+}
+
+// Flush what the agent still holds before exiting : pending summaries and completion records, then the final metrics
+func flushBeforeExit() {
+	if summaries != nil {
+		summaries.flushAll()
+	}
+	if publisher != nil {
+		publisher.flush()
+	}
+
+	// Last, so the pushed metrics account for everything else
+	if err := pushMetrics(); err != nil {
+		agentLog.Errorf("Error pushing metrics : %v\n", err)
+	}
+}
+
+// Exit the agent after flushing
+func exit(code int) {
+	flushBeforeExit()
+	os.Exit(code)
+}
+
+// Shut down cleanly on SIGINT or SIGTERM : the running jobs finish and are notified, then the agent exits once the
+// lame-duck period, if any, is over. A second signal kills the running jobs and exits right away
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		atomic.StoreInt32(&signalled, 1)
+		requestShutdown()
+		if lameDuckDuration <= 0 {
+			log.Printf("Received %s, exiting once the running jobs are done\n", sig)
+			close(lameDuckOver)
+		} else {
+			// Deliberately hold the process open, giving load balancers time to stop routing to it
+			log.Printf("Received %s, no longer claiming jobs, exiting in %s\n", sig, lameDuckDuration)
+			go func() {
+				time.Sleep(lameDuckDuration)
+				log.Println("Lame-duck period over, exiting")
+				close(lameDuckOver)
+				killJobs()
+			}()
+		}
+
+		// Not waiting for anything anymore, such as a command stuck in its grace period or a notify
+		sig = <-signals
+		log.Printf("Received %s again, killing the running jobs and exiting\n", sig)
+		killRunningGroups()
+		os.Exit(1)
+	}()
+}
+
+// Wait for the lame-duck period to end, or for the running jobs to be killed. There is none after an error
+func waitLameDuck() {
+	if atomic.LoadInt32(&signalled) == 0 {
+		return
+	}
+
+	select {
+	case <-lameDuckOver:
+	case <-jobsCtx.Done():
+	}
+}
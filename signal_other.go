@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import "os"
+
+// Processes are not terminated by signals on this platform
+func terminationSignal(state *os.ProcessState) string {
+	return ""
+}
+
+// There is no SIGPIPE on this platform
+func handleBrokenPipes() {}
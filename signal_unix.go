@@ -0,0 +1,59 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGTRAP: "SIGTRAP",
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGUSR1: "SIGUSR1",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGUSR2: "SIGUSR2",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGALRM: "SIGALRM",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGXCPU: "SIGXCPU",
+	syscall.SIGXFSZ: "SIGXFSZ",
+}
+
+// Name of the signal which terminated a process, empty if it exited by itself
+func terminationSignal(state *os.ProcessState) string {
+	if state == nil {
+		return ""
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return ""
+	}
+
+	if name, ok := signalNames[status.Signal()]; ok {
+		return name
+	}
+	return fmt.Sprintf("signal %d", int(status.Signal()))
+}
+
+// Keep the agent running when the reader of its logs goes away : writing them then fails with EPIPE, instead of the
+// agent being killed by SIGPIPE. Unlike ignoring it, handling the signal does not pass on to the commands
+func handleBrokenPipes() {
+	pipes := make(chan os.Signal, 1)
+	signal.Notify(pipes, syscall.SIGPIPE)
+
+	go func() {
+		// Not logged, the logs are what is broken
+		for range pipes {
+		}
+	}()
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directory where results are kept until the API acknowledged them, empty when disabled
+var spoolDir string
+
+// Limits of the spool, 0 for no limit
+var (
+	spoolMaxBytes = 1024 * 1024 * 1024
+	spoolMaxFiles = 10000
+)
+
+// What happens once the spool is full : "evict-oldest" drops the oldest results, "backpressure" stops claiming jobs
+var spoolOverflow = "evict-oldest"
+
+// Serializes the changes to the spool between the running jobs
+var spoolLock sync.Mutex
+
+// Files of the spool whose run is still delivering them, which replays leave alone
+var spoolInFlight = map[string]bool{}
+
+// Interval between replays of the spool while the agent runs
+var spoolReplayInterval = time.Minute
+
+// Held by the replay in progress, so replays never overlap
+var spoolReplayMu sync.Mutex
+
+// Result kept in the spool, enough to notify it again
+type spooledResult struct {
+	Job    jobConfig `json:"job"`
+	Result runResult `json:"result"`
+}
+
+// Characters of a run ID which can not be used in a file name
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+type spoolFile struct {
+	path string
+	size int64
+}
+
+// Files of the spool, oldest first
+func spoolFiles() ([]spoolFile, error) {
+	entries, err := os.ReadDir(spoolDir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []spoolFile{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, spoolFile{path: filepath.Join(spoolDir, entry.Name()), size: info.Size()})
+	}
+
+	// Names start with the time they were written at
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].path < files[j].path
+	})
+
+	return files, nil
+}
+
+// Whether adding a file of the given size to the spool would go over its limits
+func spoolOverLimits(files []spoolFile, size int64) bool {
+	total := size
+	for _, file := range files {
+		total += file.size
+	}
+
+	return (spoolMaxFiles > 0 && len(files)+1 > spoolMaxFiles) || (spoolMaxBytes > 0 && total > int64(spoolMaxBytes))
+}
+
+// Make room in the spool for a result of the given size, dropping the oldest results. The spool lock must be held
+func evictSpool(job jobConfig, size int64) error {
+	files, err := spoolFiles()
+	if err != nil {
+		return err
+	}
+	for len(files) > 0 && spoolOverLimits(files, size) {
+		runLog(job).Warnf("Spool full, dropping the result in %s\n", files[0].path)
+		if err := os.Remove(files[0].path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		files = files[1:]
+	}
+
+	return nil
+}
+
+// Keep a run's result in the spool until it is acknowledged. Returns the path of its file, empty when disabled
+func spoolResult(job jobConfig, result runResult) (string, error) {
+	if spoolDir == "" {
+		return "", nil
+	}
+
+	// The environment may hold secrets, and is not needed to notify
+	job.Env = nil
+	content, err := json.Marshal(spooledResult{Job: job, Result: result})
+	if err != nil {
+		return "", err
+	}
+
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+
+	if spoolOverflow == "evict-oldest" {
+		if err := evictSpool(job, int64(len(content))); err != nil {
+			return "", err
+		}
+	}
+
+	// Written aside then renamed, so a crash never leaves a partial result behind
+	name := fmt.Sprintf("%020d-%s.json", time.Now().UnixNano(), unsafeFileChars.ReplaceAllString(job.ID, "_"))
+	path := filepath.Join(spoolDir, name)
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, content, 0o600); err != nil {
+		os.Remove(temp)
+		return "", err
+	}
+	if err := os.Rename(temp, path); err != nil {
+		os.Remove(temp)
+		return "", err
+	}
+	spoolInFlight[path] = true
+
+	return path, nil
+}
+
+// Leave a result which could not be delivered to the replays
+func keepSpooled(path string) {
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+
+	delete(spoolInFlight, path)
+}
+
+// Remove the files of writes interrupted by a crash
+func removeSpoolLeftovers() {
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+
+	temps, err := filepath.Glob(filepath.Join(spoolDir, "*.json.tmp"))
+	if err != nil {
+		return
+	}
+	for _, temp := range temps {
+		if err := os.Remove(temp); err != nil && !os.IsNotExist(err) {
+			agentLog.Errorf("Error removing the interrupted spool write %s : %v\n", temp, err)
+		}
+	}
+}
+
+// Remove an acknowledged result from the spool. It may already have been evicted
+func unspool(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+
+	delete(spoolInFlight, path)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Whether claiming should stop, the spool having no room left for more results
+func spoolFull() bool {
+	if spoolDir == "" || spoolOverflow != "backpressure" {
+		return false
+	}
+
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+
+	files, err := spoolFiles()
+	if err != nil {
+		return false
+	}
+	return spoolOverLimits(files, 0)
+}
+
+// Notify the results left in the spool by a previous run of the agent or by an outage. Those which still can not be
+// delivered are kept for the next replay, the results still being delivered by their run are left alone
+func (a *Agent) replaySpool() {
+	// Until the process which re-executed the agent exits, it may still be delivering spooled results
+	if parentRunning() {
+		return
+	}
+	if !spoolReplayMu.TryLock() {
+		return
+	}
+	defer spoolReplayMu.Unlock()
+
+	spoolLock.Lock()
+	files, err := spoolFiles()
+	pending := []spoolFile{}
+	for _, file := range files {
+		if !spoolInFlight[file.path] {
+			pending = append(pending, file)
+		}
+	}
+	spoolLock.Unlock()
+	if err != nil {
+		agentLog.Errorf("Error reading the spool : %v\n", err)
+		return
+	}
+	if len(pending) > 0 {
+		log.Printf("Replaying %d spooled results\n", len(pending))
+	}
+
+	for _, file := range pending {
+		content, err := os.ReadFile(file.path)
+		if err != nil {
+			agentLog.Errorf("Error reading spooled result %s : %v\n", file.path, err)
+			continue
+		}
+
+		var spooled spooledResult
+		if err := json.Unmarshal(content, &spooled); err != nil {
+			// Nothing can be done with it
+			agentLog.Errorf("Dropping malformed spooled result %s : %v\n", file.path, err)
+			os.Remove(file.path)
+			continue
+		}
+
+		err = a.deliverResult(spooled.Job, spooled.Result)
+		if err != nil && isTransientNotifyError(err) {
+			runLog(spooled.Job).Errorf("Error replaying the result of run %s : %v, keeping it\n", spooled.Job.ID, err)
+			continue
+		}
+		if err != nil && !errors.Is(err, errAlreadyCompleted) {
+			runLog(spooled.Job).Errorf("Result of run %s was rejected : %v\n", spooled.Job.ID, err)
+		}
+		if err := unspool(file.path); err != nil {
+			agentLog.Errorf("Error removing spooled result %s : %v\n", file.path, err)
+		}
+	}
+}
+
+// Replay the spool periodically until the shutdown, so the results kept through an outage are delivered once the API
+// is back
+func (a *Agent) replaySpoolPeriodically() {
+	for {
+		sleepUnlessShutdown(spoolReplayInterval)
+		if shuttingDown() {
+			return
+		}
+		a.replaySpool()
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// Retries of a command start failing for lack of resources, and the delay before the first one
+var startRetries = 3
+var startRetryDelay = time.Second
+
+// Whether a start error is transient : fork/exec may fail under load while the system is out of processes or memory
+func isTransientStartError(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ENOMEM)
+}
+
+// Start a command, retrying on transient errors. A command can only be started once, so it is rebuilt for every attempt
+func startWithRetry(newCmd func() *exec.Cmd) (*exec.Cmd, int, error) {
+	delay := startRetryDelay
+	for attempt := 0; ; attempt++ {
+		cmd := newCmd()
+		err := cmd.Start()
+		if err == nil || !isTransientStartError(err) || attempt >= startRetries {
+			return cmd, attempt, err
+		}
+
+		agentLog.Warnf("Could not start command (%v), retrying in %s\n", err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Directory where the agent persists its own state across restarts, optional
+var stateDir string
+
+var agentStartedAt = time.Now()
+
+// Number of times the agent started before this process, persisted in the state dir
+var restartCount int
+
+// Read the boot counter from the state dir and count this boot, so crash-looping runners can be spotted
+func countRestart() error {
+	if stateDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return err
+	}
+
+	path := filepath.Join(stateDir, "restart_count")
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		// A corrupted counter starts over rather than preventing the agent from running
+		restartCount, _ = strconv.Atoi(strings.TrimSpace(string(content)))
+	}
+
+	// Write then rename, so a crash while writing does not lose the count
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(restartCount+1)), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func uptime() time.Duration {
+	return time.Since(agentStartedAt)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// Whether a run completes once the command closed its STDOUT, instead of waiting for it to exit.
+// Meant for commands which signal they are done by closing their output, but keep running or leave a daemon behind
+var completeOnStdoutEOF bool
+
+// Time left to the command to exit by itself after closing its STDOUT, before its survivors are killed
+var stdoutEOFGrace = 5 * time.Second
+
+// Pipe set as the command's STDOUT, telling when the command (and its descendants) closed it
+type stdoutPipe struct {
+	reader *os.File
+	writer *os.File
+	eof    chan struct{}
+}
+
+// Open the STDOUT pipe of a command, whose content is copied to out
+func openStdoutPipe(out io.Writer) (*stdoutPipe, error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := &stdoutPipe{
+		reader: reader,
+		writer: writer,
+		eof:    make(chan struct{}),
+	}
+
+	go func() {
+		io.Copy(out, reader)
+		reader.Close()
+		close(pipe.eof)
+	}()
+
+	return pipe, nil
+}
+
+// Wait for the end of the output, giving up after the timeout. Returns false when it gave up
+func (p *stdoutPipe) waitFor(timeout time.Duration) bool {
+	return waitForPipe(p.eof, p.reader, timeout)
+}
+
+// Release the agent's copy of the write end once the command started (or failed to)
+func (p *stdoutPipe) closeWriter() {
+	p.writer.Close()
+}
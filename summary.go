@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failed runs whose logs are kept as samples in a summary
+const summaryFailureSamples = 5
+
+// Full batches of runs kept per command while their summaries fail to be sent, past which the oldest runs are dropped
+const summaryPendingBatches = 10
+
+type summaryFailure struct {
+	RunID string `json:"run_id"`
+	Logs  string `json:"logs"`
+}
+
+// Results of several runs of a command, sent as a single notification
+type jobSummary struct {
+	Command   string           `json:"command"`
+	RunIDs    []string         `json:"run_ids"`
+	Succeeded int              `json:"succeeded"`
+	Failed    int              `json:"failed"`
+	Failures  []summaryFailure `json:"failures"`
+
+	// Outcome of each run, in the order of RunIDs
+	outcomes []bool
+}
+
+// Drop the oldest runs past limit, returning how many were
+func (s *jobSummary) dropOldest(limit int) int {
+	dropped := len(s.RunIDs) - limit
+	if dropped <= 0 {
+		return 0
+	}
+
+	removed := map[string]bool{}
+	for i, runID := range s.RunIDs[:dropped] {
+		removed[runID] = true
+		if s.outcomes[i] {
+			s.Succeeded--
+		} else {
+			s.Failed--
+		}
+	}
+	s.RunIDs = s.RunIDs[dropped:]
+	s.outcomes = s.outcomes[dropped:]
+
+	failures := []summaryFailure{}
+	for _, failure := range s.Failures {
+		if !removed[failure.RunID] {
+			failures = append(failures, failure)
+		}
+	}
+	s.Failures = failures
+
+	return dropped
+}
+
+// Aggregates the results of chatty commands, flushed periodically or once a batch is full
+type summaryBatcher struct {
+	agent     *Agent
+	mu        sync.Mutex
+	commands  map[string]bool
+	maxSize   int
+	summaries map[string]*jobSummary
+}
+
+// Batcher of the commands listed in ZETTO_SUMMARY_COMMANDS, nil when summary mode is not used
+var summaries *summaryBatcher
+
+func newSummaryBatcher(agent *Agent, commands []string, interval time.Duration, maxSize int) *summaryBatcher {
+	batcher := &summaryBatcher{
+		agent:     agent,
+		commands:  map[string]bool{},
+		maxSize:   maxSize,
+		summaries: map[string]*jobSummary{},
+	}
+	for _, command := range commands {
+		if command = strings.TrimSpace(command); command != "" {
+			batcher.commands[command] = true
+		}
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			batcher.flushAll()
+		}
+	}()
+
+	return batcher
+}
+
+// Whether results of this command are summarized instead of notified one by one
+func (b *summaryBatcher) handles(command string) bool {
+	return b != nil && b.commands[command]
+}
+
+// Add a run result to the summary of its command, flushing it once full
+func (b *summaryBatcher) add(job jobConfig, result runResult) {
+	b.mu.Lock()
+	summary, ok := b.summaries[job.Command]
+	if !ok {
+		summary = &jobSummary{
+			Command:  job.Command,
+			Failures: []summaryFailure{},
+		}
+		b.summaries[job.Command] = summary
+	}
+
+	summary.RunIDs = append(summary.RunIDs, job.ID)
+	summary.outcomes = append(summary.outcomes, result.Success)
+	if result.Success {
+		summary.Succeeded++
+	} else {
+		summary.Failed++
+		if len(summary.Failures) < summaryFailureSamples {
+			summary.Failures = append(summary.Failures, summaryFailure{RunID: job.ID, Logs: result.Logs})
+		}
+	}
+	full := len(summary.RunIDs) >= b.maxSize
+	b.trim(summary)
+	b.mu.Unlock()
+
+	if full {
+		b.flush(job.Command)
+	}
+}
+
+func (b *summaryBatcher) flushAll() {
+	b.mu.Lock()
+	commands := []string{}
+	for command := range b.summaries {
+		commands = append(commands, command)
+	}
+	b.mu.Unlock()
+
+	for _, command := range commands {
+		b.flush(command)
+	}
+}
+
+// Send the pending summary of a command. On failure its results are merged back, to be sent with the next flush
+func (b *summaryBatcher) flush(command string) {
+	b.mu.Lock()
+	summary, ok := b.summaries[command]
+	delete(b.summaries, command)
+	b.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	err := b.agent.notifySummary(*summary)
+	if err == nil {
+		return
+	}
+	agentLog.Errorf("Error notifying summary : %v\n", err)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if newer, ok := b.summaries[command]; ok {
+		summary.RunIDs = append(summary.RunIDs, newer.RunIDs...)
+		summary.outcomes = append(summary.outcomes, newer.outcomes...)
+		summary.Succeeded += newer.Succeeded
+		summary.Failed += newer.Failed
+		for _, failure := range newer.Failures {
+			if len(summary.Failures) < summaryFailureSamples {
+				summary.Failures = append(summary.Failures, failure)
+			}
+		}
+	}
+	b.trim(summary)
+	b.summaries[command] = summary
+}
+
+// Bound a summary kept while the API fails, dropping its oldest runs
+func (b *summaryBatcher) trim(summary *jobSummary) {
+	if dropped := summary.dropOldest(b.maxSize * summaryPendingBatches); dropped > 0 {
+		agentLog.Warnf("Too many unsent %s runs, dropping the %d oldest from their summary\n", summary.Command, dropped)
+	}
+}
+
+// Notify the API of a summary of runs
+func (a *Agent) notifySummary(summary jobSummary) error {
+	payload, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Sending summary of %d %s runs\n", len(summary.RunIDs), summary.Command)
+
+	req, err := a.newRequest("POST", "notify-summary", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+
+	res, err := a.NotifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Summary notify error %d", res.StatusCode)
+	}
+
+	return nil
+}
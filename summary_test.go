@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSummaryFailedFlushes(t *testing.T) {
+	api := newFakeAPI(t)
+	batcher := newSummaryBatcher(api.agent(), []string{"report"}, time.Hour, 2)
+
+	// Every flush fails while the runs pile up
+	statuses := []int{}
+	for i := 0; i < 30; i++ {
+		statuses = append(statuses, http.StatusServiceUnavailable)
+	}
+	api.failNext("/notify-summary", statuses...)
+	for i := 0; i < 30; i++ {
+		batcher.add(jobConfig{ID: fmt.Sprintf("run-%d", i), Command: "report"}, runResult{Success: i >= 3, Logs: "failed"})
+	}
+	batcher.flushAll()
+
+	// Only the newest runs are kept, counts and samples follow them
+	requests := api.requestsTo("/notify-summary")
+	var summary jobSummary
+	if err := json.Unmarshal(requests[len(requests)-1].Body, &summary); err != nil {
+		t.Fatal(err)
+	}
+	limit := 2 * summaryPendingBatches
+	if len(summary.RunIDs) != limit || summary.RunIDs[0] != fmt.Sprintf("run-%d", 30-limit) {
+		t.Errorf("got runs %v, want the %d newest", summary.RunIDs, limit)
+	}
+	if summary.Succeeded != limit || summary.Failed != 0 || len(summary.Failures) != 0 {
+		t.Errorf("got %d succeeded, %d failed and %d failure samples", summary.Succeeded, summary.Failed, len(summary.Failures))
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+// Whether the logs of each run are also sent to syslog
+var syslogJobLogsEnabled bool
+
+// Send a log line of the given level to syslog, nil when disabled
+var sendToSyslog func(level string, line string)
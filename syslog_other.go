@@ -0,0 +1,15 @@
+//go:build windows || plan9
+
+package main
+
+import "log"
+
+// Syslog is not available on this platform
+func initSyslog(network string, addr string, facility string) error {
+	if addr != "" {
+		log.Println("Syslog is not supported on this platform, ignoring ZETTO_SYSLOG_ADDR")
+	}
+	return nil
+}
+
+func syslogJobLogs(job jobConfig, result runResult) {}
@@ -0,0 +1,166 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lines kept while the syslog server is unreachable, past which the oldest ones are dropped
+const syslogBufferSize = 1000
+
+// Bound of a connection to the syslog server, and of each write on it
+const syslogTimeout = 5 * time.Second
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL, "daemon": syslog.LOG_DAEMON,
+	"auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG, "lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS,
+	"uucp": syslog.LOG_UUCP, "cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2, "local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5, "local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// Syslog severities of the log levels
+var syslogSeverities = map[string]syslog.Priority{
+	levelDebug: syslog.LOG_DEBUG,
+	levelInfo:  syslog.LOG_INFO,
+	levelWarn:  syslog.LOG_WARNING,
+	levelError: syslog.LOG_ERR,
+}
+
+type syslogLine struct {
+	severity syslog.Priority
+	text     string
+}
+
+// Ships log lines to a syslog server from its own goroutine, so a slow or dead server never holds up the logging
+// ones. Lines are kept while it is unreachable, and it is reconnected to with a backoff
+type syslogWriter struct {
+	network  string
+	addr     string
+	facility syslog.Priority
+	hostname string
+
+	mu      sync.Mutex
+	pending []syslogLine
+
+	wake chan struct{}
+}
+
+// Syslog destination of the agent's logs, nil when disabled
+var syslogger *syslogWriter
+
+// Also send the agent's logs to ZETTO_SYSLOG_ADDR
+func initSyslog(network string, addr string, facility string) error {
+	if addr == "" {
+		return nil
+	}
+
+	priority, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return fmt.Errorf("unknown syslog facility %q", facility)
+	}
+
+	hostname, _ := os.Hostname()
+	syslogger = &syslogWriter{
+		network:  network,
+		addr:     addr,
+		facility: priority,
+		hostname: hostname,
+		wake:     make(chan struct{}, 1),
+	}
+	sendToSyslog = syslogger.send
+	go syslogger.run()
+
+	return nil
+}
+
+// Queue a line of the given log level, without ever blocking
+func (w *syslogWriter) send(level string, line string) {
+	severity, ok := syslogSeverities[level]
+	if !ok {
+		severity = syslog.LOG_INFO
+	}
+
+	w.mu.Lock()
+	w.pending = append(w.pending, syslogLine{severity: severity, text: strings.TrimRight(line, "\n")})
+	if len(w.pending) > syslogBufferSize {
+		w.pending = w.pending[len(w.pending)-syslogBufferSize:]
+	}
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Deliver the queued lines in order, reconnecting with a backoff while the server is unreachable
+func (w *syslogWriter) run() {
+	var conn net.Conn
+	retries := newBackoff(time.Second, time.Minute)
+	for range w.wake {
+		for {
+			w.mu.Lock()
+			if len(w.pending) == 0 {
+				w.mu.Unlock()
+				break
+			}
+			line := w.pending[0]
+			w.mu.Unlock()
+
+			if conn == nil {
+				var err error
+				if conn, err = net.DialTimeout(w.network, w.addr, syslogTimeout); err != nil {
+					conn = nil
+					time.Sleep(retries.failed())
+					continue
+				}
+			}
+
+			if err := w.write(conn, line); err != nil {
+				conn.Close()
+				conn = nil
+				time.Sleep(retries.failed())
+				continue
+			}
+			retries.succeeded()
+
+			w.mu.Lock()
+			// The line may have been dropped meanwhile, should the buffer have overflowed
+			if len(w.pending) > 0 && w.pending[0] == line {
+				w.pending = w.pending[1:]
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// Write a line in the format of log/syslog for remote servers
+func (w *syslogWriter) write(conn net.Conn, line syslogLine) error {
+	conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	_, err := fmt.Fprintf(conn, "<%d>%s %s zetto-agent[%d]: %s\n",
+		w.facility|line.severity, time.Now().Format(time.RFC3339), w.hostname, os.Getpid(), line.text)
+	return err
+}
+
+// Send the logs of a run to syslog, tagged with its run ID, as errors when the run failed
+func syslogJobLogs(job jobConfig, result runResult) {
+	if syslogger == nil || !syslogJobLogsEnabled || result.Logs == "" {
+		return
+	}
+
+	prefix, level := "Run "+job.ID+" ("+job.Command+") : ", levelInfo
+	if !result.Success {
+		prefix, level = "Error in run "+job.ID+" ("+job.Command+") : ", levelError
+	}
+	for _, line := range strings.Split(strings.TrimRight(result.Logs, "\n"), "\n") {
+		syslogger.send(level, redactLog(prefix+line))
+	}
+}
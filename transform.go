@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// Command reshaping notify payloads, given on STDIN and replaced by its STDOUT. Empty when disabled
+var transformCommand []string
+
+var transformTimeout = 10 * time.Second
+
+// Whether a failed transformation withholds the run's result, rather than sending the original payload
+var transformFailClosed bool
+
+// Pass a notify payload through the transform command
+func transformPayload(payload []byte) ([]byte, error) {
+	if len(transformCommand) == 0 {
+		return payload, nil
+	}
+
+	transformed, err := runTransform(payload)
+	if err == nil {
+		return transformed, nil
+	}
+
+	agentLog.Errorf("Error transforming payload : %v\n", err)
+	if !transformFailClosed {
+		return payload, nil
+	}
+
+	// Fail closed : the original payload may hold what the transformation was meant to remove
+	original := jobNotify{}
+	if err := json.Unmarshal(payload, &original); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jobNotify{
+		RunID:   original.RunID,
+		Success: false,
+		Output:  "null",
+		Reason:  "transform_failed",
+	})
+}
+
+func runTransform(payload []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), transformTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, transformCommand[0], transformCommand[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("transform timed out after %s", transformTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The result must still be a notify payload, for the same run
+	transformed := jobNotify{}
+	if err := json.Unmarshal(out, &transformed); err != nil {
+		return nil, fmt.Errorf("invalid transformed payload : %v", err)
+	}
+	original := jobNotify{}
+	json.Unmarshal(payload, &original)
+	if transformed.RunID != original.RunID {
+		return nil, fmt.Errorf("transformed payload is for run %q instead of %q", transformed.RunID, original.RunID)
+	}
+
+	return bytes.TrimSpace(out), nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Command checking the output of successful runs, called as $ZETTO_VERIFY_COMMAND <command> <run id> with the output on STDIN.
+// Empty when disabled
+var verifyCommand []string
+
+var verifyTimeout = 30 * time.Second
+
+// Downgrade a successful run to failed when the verification command rejects its output
+func verifyResult(job jobConfig, result *runResult) {
+	if len(verifyCommand) == 0 || !result.Success {
+		return
+	}
+
+	err := runVerification(job, result.Output)
+	if err == nil {
+		return
+	}
+
+	runLog(job).Warnf("Verification failed for run %s : %v\n", job.ID, err)
+	result.Success = false
+	result.Output = "null"
+	result.Reason = "verification_failed"
+	result.Logs = appendLog(result.Logs, fmt.Sprintf("Verification failed : %v", err))
+}
+
+func runVerification(job jobConfig, output string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+	defer cancel()
+
+	args := append(append([]string{}, verifyCommand[1:]...), job.Command, job.ID)
+	cmd := exec.CommandContext(ctx, verifyCommand[0], args...)
+	cmd.Stdin = strings.NewReader(output)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("verifier timed out after %s", verifyTimeout)
+	}
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return fmt.Errorf("%v : %s", err, message)
+		}
+		return err
+	}
+
+	return nil
+}
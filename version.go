@@ -0,0 +1,24 @@
+package main
+
+import "fmt"
+
+// Build information, set at build time with -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// Identification of the build, printed at startup and by -version
+func versionString() string {
+	return fmt.Sprintf("zetto-agent %s (commit %s, built %s)", version, commit, buildDate)
+}
+
+// Product token of the User-Agent, which forks may replace with ZETTO_USER_AGENT
+var userAgentProduct = "zetto-agent"
+
+// User-Agent of the agent's requests, such as zetto-agent/1.2.0 (runner-1), for the API to tell agents and their
+// versions apart
+func userAgent(hostname string) string {
+	return fmt.Sprintf("%s/%s (%s)", userAgentProduct, version, hostname)
+}
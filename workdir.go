@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Directory the commands start in, the agent's own when empty
+var workdir string
+
+// Whether each run starts in a temp directory of its own, removed after the run
+var tempWorkdir bool
+
+// Check that a directory exists and can be listed
+func checkWorkdir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Directory a job starts in, and a function removing it once the run is done when it is a temp one. The job's own
+// directory takes precedence over the temp and global ones
+func jobWorkdir(job jobConfig) (string, func(), error) {
+	if job.Workdir != "" {
+		if err := checkWorkdir(job.Workdir); err != nil {
+			return "", nil, fmt.Errorf("Invalid working directory : %v", err)
+		}
+		return job.Workdir, func() {}, nil
+	}
+
+	if !tempWorkdir {
+		return workdir, func() {}, nil
+	}
+
+	// Created in the global directory when there is one, so the runs stay on its filesystem
+	dir, err := os.MkdirTemp(workdir, "zetto-run-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("Could not create the working directory : %v", err)
+	}
+	return dir, func() {
+		if err := os.RemoveAll(dir); err != nil {
+			runLog(job).Errorf("Error removing the working directory : %v\n", err)
+		}
+	}, nil
+}